@@ -21,21 +21,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/smtp"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bigkevmcd/go-configparser"
 	"github.com/dnsimple/dnsimple-go/dnsimple"
 	"github.com/miekg/dns"
+	"github.com/shopspring/decimal"
 )
 
 type configuration struct {
@@ -46,6 +52,12 @@ type configuration struct {
 	dsDigestType   uint8
 	apiEndpoint    string
 	defaultContact int
+	whoisPrivacy   bool
+	autoRenew      bool
+	smtpServer     string
+	alertFrom      string
+	maxSpend       decimal.Decimal
+	currency       string
 }
 
 // global variable declarations
@@ -56,23 +68,45 @@ var (
 	version        = flag.Bool("version", false, "the code version")
 	revision       = flag.Bool("revision", false, "revision and build information")
 	forceOperation = flag.Bool("force", false, "force the current operation ignoring any warnings (will still be output)")
+	outputFormat   = flag.String("output", "text", "output format for reports; text or json, and csv where supported")
 	config         configuration
-	tc             *http.Client     // pointer to the global token client object
-	apiClient      *dnsimple.Client // pointer to the global API client object
+	tc             *http.Client                 // pointer to the global token client object
+	apiClient      *dnsimple.Client             // pointer to the global API client object
+	apiClientOnce  sync.Once                    // makes sure the client is created once, even by concurrent workers
+	promptInput    *os.File         = os.Stdin  // where answers to prompts are read from; see usePromptTerminal
+	reportOutput   *os.File         = os.Stdout // where JSON and CSV reports are written; see setupOutput
 	versionString  string           = "devel"
 )
 
+// setupOutput keeps standard output for the JSON document when the output is JSON, so that it stays
+// parseable; everything else that would have been printed goes to standard error instead
+// It should be called once the flags have been parsed
+func setupOutput() {
+	if *outputFormat == "json" {
+		os.Stdout = os.Stderr
+	}
+}
+
+// promptOutput returns where prompts are written; standard error when the output is JSON, so that
+// the JSON on standard output stays parseable
+func promptOutput() *os.File {
+	if *outputFormat == "json" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
 // askUserYesNo takes a string and prompts the user with that string and a y/N
 // If the user replies with y, Y, yes, Yes, then it returns true
 // Anything else returns false
 // It takes one parameter, the string to be prompted to the user
 // It returns one bool depending on whether the user said Y or not.
 func askUserYesNo(s string) bool {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("%s [y/N]: ", s)
+	reader := bufio.NewReader(promptInput)
+	fmt.Fprintf(promptOutput(), "%s [y/N]: ", s)
 	response, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: error requesting confirmation from user: %s\n", err)
+		fmt.Fprintf(os.Stderr, "Error: error requesting confirmation from user: %s (-force skips confirmation)\n", err)
 		os.Exit(1)
 	}
 	response = strings.ToLower(strings.TrimSpace(response))
@@ -89,22 +123,105 @@ func askUserYesNo(s string) bool {
 	}
 }
 
+// askUserString takes a string and prompts the user with it, returning what the user typed
+// It takes one parameter, the string to be prompted to the user
+// It returns the user's response with surrounding whitespace removed
+func askUserString(s string) string {
+	reader := bufio.NewReader(promptInput)
+	fmt.Fprintf(promptOutput(), "%s: ", s)
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: error requesting input from user: %s\n", err)
+		os.Exit(1)
+	}
+	response = strings.TrimSpace(response)
+	_debug(fmt.Sprintf("user replied to prompt with [%s]", response))
+	return response
+}
+
+// stdinIsTerminal reports whether prompts are read from a terminal (standard input, unless it has been
+// used for something else), so that we know whether it's reasonable to prompt the user to pick from a menu
+// It returns true if there's a TTY to prompt on
+func stdinIsTerminal() bool {
+	fi, err := promptInput.Stat()
+	if err != nil {
+		_debug(fmt.Sprintf("unable to stat stdin: %s", err))
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// usePromptTerminal switches prompts to read from the controlling terminal, for when standard input has
+// been used for something else, such as a list of domains
+// It returns an error object if there's no terminal to read from
+func usePromptTerminal() error {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return fmt.Errorf("standard input has been read, and there is no terminal to prompt on: %s", err)
+	}
+	_debug("prompts will be read from /dev/tty")
+	promptInput = tty
+	return nil
+}
+
+// sendEmail sends a plain text e-mail through the SMTP server in the configuration
+// It takes three parameters, the recipient address, the subject and the body
+// It returns an error object
+func sendEmail(to string, subject string, body string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s", config.alertFrom, to, subject, strings.ReplaceAll(body, "\n", "\r\n"))
+	err := smtp.SendMail(config.smtpServer, nil, config.alertFrom, []string{to}, []byte(msg))
+	if err != nil {
+		return fmt.Errorf("error sending e-mail to %s via %s: %s", to, config.smtpServer, err)
+	}
+	_debug(fmt.Sprintf("e-mail sent to %s via %s", to, config.smtpServer))
+	return nil
+}
+
+// postWebhook posts a JSON payload to a webhook URL
+// It takes two parameters, the URL and the payload to be encoded as JSON
+// It returns an error object
+func postWebhook(url string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding webhook payload: %s", err)
+	}
+	c := &http.Client{Timeout: 30 * time.Second}
+	r, err := c.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("error posting to webhook %s: %s", url, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", url, r.Status)
+	}
+	_debug(fmt.Sprintf("webhook %s returned %s", url, r.Status))
+	return nil
+}
+
 // doQuery performs DNS lookups. It takes two parameters, the domain to be looked up and the qtype
 // queries are performed over TCP, with DO and RD set
 // queries are sent to the nameserver and port parsed from the config
 // It returns the dns response object amd an error object
 func doQuery(qname string, qtype uint16) (*dns.Msg, error) {
+	return doQueryToServer(net.JoinHostPort(config.nameserverAddr, config.nameserverPort), qname, qtype, true)
+}
+
+// doQueryToServer performs DNS lookups against a specific server
+// It takes four parameters, the server (as host:port), the domain to be looked up, the qtype and whether to set RD
+// queries are performed over TCP, with DO set
+// It returns the dns response object amd an error object
+func doQueryToServer(server string, qname string, qtype uint16, rd bool) (*dns.Msg, error) {
 
-	_debug(fmt.Sprintf("Sending query for %s/%s to %s", qname, dns.TypeToString[qtype], net.JoinHostPort(config.nameserverAddr, config.nameserverPort)))
+	_debug(fmt.Sprintf("Sending query for %s/%s to %s", qname, dns.TypeToString[qtype], server))
 
 	c := new(dns.Client)
 	c.Net = "tcp"
 	m := new(dns.Msg)
-	m.RecursionDesired = true
+	m.RecursionDesired = rd
 	m.SetEdns0(4096, true) // do DNSKEY (set DO, as we want AD)
 	m.SetQuestion(dns.Fqdn(qname), qtype)
-	r, rtt, err := c.Exchange(m, net.JoinHostPort(config.nameserverAddr, config.nameserverPort))
-	_verbose(fmt.Sprintf("Response received for %s/%s from %s:%s in %s", qname, dns.TypeToString[qtype], config.nameserverAddr, config.nameserverPort, rtt))
+	r, rtt, err := c.Exchange(m, server)
+	_verbose(fmt.Sprintf("Response received for %s/%s from %s in %s", qname, dns.TypeToString[qtype], server, rtt))
 	if err != nil {
 		_debug(fmt.Sprintf("Error: query for %s/%s resulted in error: %s", qname, dns.TypeToString[qtype], err))
 		return nil, err
@@ -122,23 +239,19 @@ func doQuery(qname string, qtype uint16) (*dns.Msg, error) {
 // it returns a pointer to the client object
 func getApiClient() *dnsimple.Client {
 	// feels like there's not a lot of error catching/handling going on here...
-	if tc == nil {
+	// the client is shared by the concurrent bulk checks, so it's only ever set up once, and the endpoint
+	// only set then, rather than written on each call while other goroutines are reading it
+	apiClientOnce.Do(func() {
 		_debug("token client does not exist, so creating it")
 		tc = dnsimple.StaticTokenHTTPClient(context.Background(), config.apiKey)
-	} else {
-		_debug("using existing token client")
-	}
-	if apiClient == nil {
 		_debug("api client doesn't exist, so creating it")
 		apiClient = dnsimple.NewClient(tc)
-	} else {
-		_debug("using existing api client object")
-	}
-	if apiClient != nil && config.apiEndpoint != "" {
-		_debug(fmt.Sprintf("setting API endpoint to %s", config.apiEndpoint))
-		//		apiClient.BaseURL = "https://api.sandbox.dnsimple.com"
-		apiClient.BaseURL = config.apiEndpoint
-	}
+		if config.apiEndpoint != "" {
+			_debug(fmt.Sprintf("setting API endpoint to %s", config.apiEndpoint))
+			//		apiClient.BaseURL = "https://api.sandbox.dnsimple.com"
+			apiClient.BaseURL = config.apiEndpoint
+		}
+	})
 	return apiClient
 }
 
@@ -164,24 +277,52 @@ func domainExistsInAccount(domain string) (bool, error) {
 // Takes one parameter, allowing the list to be matched to a subset
 // Returns a map of Domain objects and an error object
 func getDomainsInAccount(domain string) ([]dnsimple.Domain, error) {
-	client := getApiClient()
 	var listOptions dnsimple.DomainListOptions
 	if domain != "" {
 		_debug(fmt.Sprintf("constraining list to match [%s]", domain))
 		listOptions.NameLike = &domain
 	}
+	return getDomainsWithOptions(listOptions)
+}
+
+// getDomainsForRegistrant fetches the domains in the account whose registrant is the given contact
+// It takes one parameter, the contact ID
+// It returns a slice of domain objects and an error object
+func getDomainsForRegistrant(contact int64) ([]dnsimple.Domain, error) {
+	var listOptions dnsimple.DomainListOptions
+	listOptions.RegistrantID = dnsimple.Int(int(contact))
+	return getDomainsWithOptions(listOptions)
+}
+
+// getDomainsWithOptions fetches every page of the domains list matching the given options, sorted by expiry
+// It takes one parameter, the list options
+// It returns a slice of domain objects and an error object
+func getDomainsWithOptions(listOptions dnsimple.DomainListOptions) ([]dnsimple.Domain, error) {
+	client := getApiClient()
 	sortOption := "expiration:desc"
 	listOptions.ListOptions.Sort = &sortOption
-	r, err := client.Domains.ListDomains(context.Background(), config.accountNumber, &listOptions)
-	if err != nil {
-		_debug(fmt.Sprintf("Error: error fetching domains from the API: %s", err))
-		return nil, fmt.Errorf("error fetching domains from API: %s", err)
-	}
-	_debug(fmt.Sprintf("HTTP response code was %s", r.HTTPResponse.Status))
 
-	// this is likely the first API call where we may want to add pagination handling...
-	_debug(fmt.Sprintf("we are on page %d of %d at %d per page", r.Pagination.CurrentPage, r.Pagination.TotalPages, r.Pagination.PerPage))
-	return r.Data, nil
+	// walk through the pages so that bulk actions see every domain, not just the first page
+	var domains []dnsimple.Domain
+	for page := 1; ; page++ {
+		listOptions.ListOptions.Page = dnsimple.Int(page)
+		r, err := client.Domains.ListDomains(context.Background(), config.accountNumber, &listOptions)
+		if err != nil {
+			_debug(fmt.Sprintf("Error: error fetching domains from the API: %s", err))
+			return nil, fmt.Errorf("error fetching domains from API: %s", err)
+		}
+		_debug(fmt.Sprintf("HTTP response code was %s", r.HTTPResponse.Status))
+		domains = append(domains, r.Data...)
+		// a response without pagination is a single page
+		if r.Pagination == nil {
+			break
+		}
+		_debug(fmt.Sprintf("we are on page %d of %d at %d per page", r.Pagination.CurrentPage, r.Pagination.TotalPages, r.Pagination.PerPage))
+		if page >= r.Pagination.TotalPages {
+			break
+		}
+	}
+	return domains, nil
 }
 
 // listDomainsInAccount produces pretty output of the domains in the account with their expiry dates.
@@ -229,13 +370,24 @@ func dateToDaysFromNow(d string) (int, error) {
 // returns a map of contact objects and an error object
 func getContactsInAccount() ([]dnsimple.Contact, error) {
 	client := getApiClient()
-	r, e := client.Contacts.ListContacts(context.Background(), config.accountNumber, nil)
-	if e != nil {
-		_debug(fmt.Sprintf("Error: error fetching contacts from the API: %s", e))
-		return nil, fmt.Errorf("error fetching contacts from API: %s", e)
+	var listOptions dnsimple.ListOptions
+
+	// as with domains, walk through the pages so that large accounts are seen in full
+	var contacts []dnsimple.Contact
+	for page := 1; ; page++ {
+		listOptions.Page = dnsimple.Int(page)
+		r, e := client.Contacts.ListContacts(context.Background(), config.accountNumber, &listOptions)
+		if e != nil {
+			_debug(fmt.Sprintf("Error: error fetching contacts from the API: %s", e))
+			return nil, fmt.Errorf("error fetching contacts from API: %s", e)
+		}
+		_debug(fmt.Sprintf("HTTP response code was %s", r.HTTPResponse.Status))
+		contacts = append(contacts, r.Data...)
+		if r.Pagination == nil || page >= r.Pagination.TotalPages {
+			break
+		}
 	}
-	_debug(fmt.Sprintf("HTTP response code was %s", r.HTTPResponse.Status))
-	return r.Data, nil
+	return contacts, nil
 }
 
 func listContactsInAccount() {
@@ -249,6 +401,112 @@ func listContactsInAccount() {
 	}
 }
 
+// pickContact presents the contacts in the account as a numbered menu and asks the user to choose one
+// if there's only one contact, it is offered as the default
+// It fails rather than prompting if there's no terminal, so that scripts don't hang waiting for input
+// It returns the chosen contact and an error object
+func pickContact() (*dnsimple.Contact, error) {
+	if !stdinIsTerminal() {
+		return nil, fmt.Errorf("no contact given with -contact or register.defaultContact, and no terminal to choose one from")
+	}
+	c, err := getContactsInAccount()
+	if err != nil {
+		return nil, err
+	}
+	if len(c) == 0 {
+		return nil, fmt.Errorf("there are no contacts in account %s", config.accountNumber)
+	}
+
+	fmt.Fprintln(promptOutput(), "Contacts in the account:")
+	return chooseContact(c, "Choose a registrant"), nil
+}
+
+// chooseContact presents a list of contacts as a numbered menu and asks the user to choose one
+// if there's only one contact, it is offered as the default
+// It takes two parameters, the contacts and the prompt
+// It returns the chosen contact
+func chooseContact(c []dnsimple.Contact, prompt string) *dnsimple.Contact {
+	for i, cd := range c {
+		fmt.Fprintf(promptOutput(), "  %d) %d : %s %s <%s>\n", i+1, cd.ID, cd.FirstName, cd.LastName, cd.Email)
+	}
+	if len(c) == 1 {
+		prompt += " [1]"
+	} else {
+		prompt += fmt.Sprintf(" [1-%d]", len(c))
+	}
+	for {
+		response := askUserString(prompt)
+		if response == "" && len(c) == 1 {
+			return &c[0]
+		}
+		n, err := strconv.Atoi(response)
+		if err == nil && n >= 1 && n <= len(c) {
+			return &c[n-1]
+		}
+		fmt.Fprintf(promptOutput(), "Please enter a number between 1 and %d\n", len(c))
+	}
+}
+
+// findContact looks up a contact by its ID, or by its label, e-mail address or name
+// A number is only ever matched as an ID; a label or e-mail address matched in full wins; otherwise the query is matched as a fragment
+// of the label, e-mail address, name or organisation, ignoring case
+// If several contacts match, they're listed, and the user asked to choose if there's a terminal
+// It takes one parameter, the query
+// It returns the contact and an error object
+func findContact(query string) (*dnsimple.Contact, error) {
+	c, err := getContactsInAccount()
+	if err != nil {
+		return nil, err
+	}
+	q := strings.ToLower(strings.TrimSpace(query))
+	if q == "" {
+		return nil, fmt.Errorf("no contact given")
+	}
+
+	if id, err := strconv.ParseInt(q, 10, 64); err == nil {
+		for i := range c {
+			if c[i].ID == id {
+				return &c[i], nil
+			}
+		}
+		// a number is always an ID; matching it as a fragment could pick a different contact entirely
+		return nil, fmt.Errorf("no contact with ID %d in account %s", id, config.accountNumber)
+	}
+
+	var exact, partial []dnsimple.Contact
+	for _, cd := range c {
+		label, email := strings.ToLower(cd.Label), strings.ToLower(cd.Email)
+		name := strings.ToLower(cd.FirstName + " " + cd.LastName)
+		switch {
+		case q == label || q == email:
+			exact = append(exact, cd)
+		case strings.Contains(label, q) || strings.Contains(email, q) || strings.Contains(name, q) ||
+			strings.Contains(strings.ToLower(cd.Organization), q):
+			partial = append(partial, cd)
+		}
+	}
+	matches := exact
+	if len(matches) == 0 {
+		matches = partial
+	}
+	_debug(fmt.Sprintf("contact query [%s] matched %d in full and %d in part", query, len(exact), len(partial)))
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no contact in account %s matches %s", config.accountNumber, query)
+	case 1:
+		return &matches[0], nil
+	}
+	fmt.Fprintf(promptOutput(), "%d contacts match %s:\n", len(matches), query)
+	if !stdinIsTerminal() {
+		for _, cd := range matches {
+			fmt.Fprintf(promptOutput(), "  => %d : %s %s <%s>\n", cd.ID, cd.FirstName, cd.LastName, cd.Email)
+		}
+		return nil, fmt.Errorf("%s matches more than one contact; use the contact's ID instead", query)
+	}
+	return chooseContact(matches, "Choose a contact"), nil
+}
+
 // getContactDetails fetches the details of a single contact
 // takes the contact ID name as a parameter
 // returns the contact's object and an error object
@@ -320,12 +578,66 @@ func listDomainDetails(d *dnsimple.Domain) {
 	fmt.Printf("\tUpdated At...: %s\n", d.UpdatedAt)
 }
 
+// rateLimitReserve is the number of API requests left in the hour below which we wait for the limit to reset
+const rateLimitReserve = 5
+
+// rateLimit tracks the API rate limit from the most recent response, so that concurrent checks can
+// hold off before they run out of requests
+var rateLimit struct {
+	sync.Mutex
+	known     bool
+	remaining int
+	reset     time.Time
+}
+
+// noteRateLimit records the rate limit headers from an API response
+// It takes one parameter, the HTTP response, which may be nil if the request failed
+func noteRateLimit(r *http.Response) {
+	if r == nil || r.Header.Get("X-RateLimit-Remaining") == "" {
+		return
+	}
+	remaining, err := strconv.Atoi(r.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, _ := strconv.ParseInt(r.Header.Get("X-RateLimit-Reset"), 10, 64)
+	rateLimit.Lock()
+	defer rateLimit.Unlock()
+	rateLimit.known = true
+	rateLimit.remaining = remaining
+	rateLimit.reset = time.Unix(reset, 0)
+}
+
+// waitForRateLimit blocks while the API rate limit is close to running out, until it resets
+// the lock is held while waiting, so that every caller waits rather than all of them piling in at the reset
+func waitForRateLimit() {
+	rateLimit.Lock()
+	defer rateLimit.Unlock()
+	if !rateLimit.known {
+		return
+	}
+	if rateLimit.remaining <= rateLimitReserve {
+		if wait := time.Until(rateLimit.reset); wait > 0 {
+			_verbose(fmt.Sprintf("%d API requests left; waiting %s for the rate limit to reset", rateLimit.remaining, wait.Round(time.Second)))
+			time.Sleep(wait)
+		}
+		rateLimit.known = false
+		return
+	}
+	// count this request against what's left until the response tells us otherwise
+	rateLimit.remaining--
+}
+
 // checkDomainStatus checks with a domain is available to be registered and whether it's a premium domain
 // takes one parameter, the domain to be queried
 // returns two parameters; boolean on whether the domain is available, and error if encountered
 func checkDomainStatus(domain string) (*dnsimple.DomainCheckResponse, error) {
 	client := getApiClient()
+	waitForRateLimit()
 	r, e := client.Registrar.CheckDomain(context.Background(), config.accountNumber, domain)
+	if r != nil {
+		noteRateLimit(r.HTTPResponse)
+	}
 	if e != nil {
 		return nil, fmt.Errorf("error checking status of domain %s: %s", domain, e)
 	}
@@ -333,12 +645,31 @@ func checkDomainStatus(domain string) (*dnsimple.DomainCheckResponse, error) {
 	return r, nil
 }
 
+// domainPrice is used in place of the library's DomainPrice, which holds the prices as floats;
+// decoding them straight into decimals keeps money arithmetic exact
+type domainPrice struct {
+	Domain            string          `json:"domain"`
+	Premium           bool            `json:"premium"`
+	RegistrationPrice decimal.Decimal `json:"registration_price"`
+	RenewalPrice      decimal.Decimal `json:"renewal_price"`
+	TransferPrice     decimal.Decimal `json:"transfer_price"`
+}
+
+// domainPriceResponse is the API response wrapping a domainPrice
+type domainPriceResponse struct {
+	Data *domainPrice `json:"data"`
+}
+
 // getDomainPrice fetches the prices applicable to the domain
 // takes one parameter, that being the domain to be checked
-// returns a DomainPriceResponse object and an error object
-func getDomainPrice(domain string) (*dnsimple.DomainPriceResponse, error) {
+// returns a domainPriceResponse object and an error object
+func getDomainPrice(domain string) (*domainPriceResponse, error) {
 	client := getApiClient()
-	p, e := client.Registrar.GetDomainPrices(context.Background(), config.accountNumber, domain)
+	path := fmt.Sprintf("/v2/%s/registrar/domains/%s/prices", config.accountNumber, domain)
+	p := &domainPriceResponse{}
+	waitForRateLimit()
+	r, e := client.Request(context.Background(), http.MethodGet, path, nil, p, nil)
+	noteRateLimit(r)
 	if e != nil {
 		return nil, fmt.Errorf("error checking price of domain %s: %s", domain, e)
 	}
@@ -346,6 +677,363 @@ func getDomainPrice(domain string) (*dnsimple.DomainPriceResponse, error) {
 	return p, nil
 }
 
+// currencySymbols maps the currencies we know a symbol for; others are shown by their ISO 4217 code
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"GBP": "£",
+	"EUR": "€",
+}
+
+// formatMoney formats an amount in the account's currency
+// It takes one parameter, the amount
+// It returns the amount to two decimal places, prefixed with the currency symbol or code
+func formatMoney(amount decimal.Decimal) string {
+	if symbol, ok := currencySymbols[config.currency]; ok {
+		return symbol + amount.StringFixed(2)
+	}
+	return config.currency + " " + amount.StringFixed(2)
+}
+
+// getTldForDomain fetches the registrar's details of the TLD a domain is registered under
+// multi-label TLDs such as co.uk are tried before falling back to the final label
+// It takes one parameter, the domain
+// It returns the TLD object and an error object
+func getTldForDomain(domain string) (*dnsimple.Tld, error) {
+	client := getApiClient()
+	labels := dns.SplitDomainName(domain)
+	var lastErr error
+	for i := 1; i < len(labels); i++ {
+		tld := strings.Join(labels[i:], ".")
+		r, err := client.Tlds.GetTld(context.Background(), tld)
+		if err != nil {
+			_debug(fmt.Sprintf("no TLD details for %s: %s", tld, err))
+			lastErr = err
+			continue
+		}
+		_debug(fmt.Sprintf("%+v", r.Data))
+		return r.Data, nil
+	}
+	return nil, fmt.Errorf("error fetching TLD details for domain %s: %s", domain, lastErr)
+}
+
+// getTldDnssecInterfaceType asks the registrar whether the registry for a domain takes DS digests ("ds")
+// or DNSKEY data ("key")
+// It takes one parameter, the domain
+// It returns the interface type and an error object
+func getTldDnssecInterfaceType(domain string) (string, error) {
+	tld, err := getTldForDomain(domain)
+	if err != nil {
+		return "", err
+	}
+	if tld.DnssecInterfaceType == "" {
+		_debug(fmt.Sprintf("no DNSSEC interface type for %s, assuming ds", tld.Tld))
+		return "ds", nil
+	}
+	_verbose(fmt.Sprintf("The registry for %s takes DNSSEC data as %s", tld.Tld, tld.DnssecInterfaceType))
+	return tld.DnssecInterfaceType, nil
+}
+
+// registerDomainInput is used in place of the library's RegisterDomainInput
+// it adds the registration period, which the library doesn't support, and always sends auto_renew and
+// whois_privacy, as the library omits them when false and the API defaults auto_renew to true
+type registerDomainInput struct {
+	RegistrantID       int               `json:"registrant_id"`
+	Period             int               `json:"period,omitempty"`
+	EnableWhoisPrivacy bool              `json:"whois_privacy"`
+	EnableAutoRenewal  bool              `json:"auto_renew"`
+	ExtendedAttributes map[string]string `json:"extended_attributes,omitempty"`
+	PremiumPrice       string            `json:"premium_price,omitempty"`
+}
+
+// registerDomain uses the registrar API to register a domain
+// It takes two parameters, the domain and the registration details
+// It returns the registration object and an error object
+func registerDomain(domain string, input registerDomainInput) (*dnsimple.DomainRegistration, error) {
+	client := getApiClient()
+	path := fmt.Sprintf("/v2/%s/registrar/domains/%s/registrations", config.accountNumber, domain)
+	r := &dnsimple.DomainRegistrationResponse{}
+	_, err := client.Request(context.Background(), http.MethodPost, path, input, r, nil)
+	if err != nil {
+		_debug(fmt.Sprintf("Error: error registering domain %s: %s", domain, err))
+		return nil, fmt.Errorf("error registering domain %s: %s", domain, err)
+	}
+	_debug(fmt.Sprintf("%+v", r.Data))
+	return r.Data, nil
+}
+
+// renewDomain uses the registrar API to renew a domain
+// It takes three parameters, the domain, the period in years, and the premium price, which the registry
+// requires as confirmation for premium domains and is otherwise empty
+// It returns the renewal object and an error object
+func renewDomain(domain string, period int, premiumPrice string) (*dnsimple.DomainRenewal, error) {
+	client := getApiClient()
+	r, err := client.Registrar.RenewDomain(context.Background(), config.accountNumber, domain, &dnsimple.RenewDomainInput{Period: period, PremiumPrice: premiumPrice})
+	if err != nil {
+		return nil, fmt.Errorf("error renewing domain %s: %s", domain, err)
+	}
+	_debug(fmt.Sprintf("%+v", r.Data))
+	return r.Data, nil
+}
+
+// pollInterval is how often the state of an asynchronous registrar operation is re-fetched while waiting
+const pollInterval = 30 * time.Second
+
+// asyncOperation describes a registrar operation that completes in the background, such as a
+// registration, renewal, transfer or registrant change, and how to find out its current state
+type asyncOperation struct {
+	name      string                 // what's being waited for, for the progress output
+	fetch     func() (string, error) // re-fetches the operation's current state
+	succeeded []string               // the terminal states meaning the operation worked
+	failed    []string               // the terminal states meaning it didn't
+}
+
+// waitForOperation re-fetches the state of an operation until it reaches a terminal state or the
+// timeout passes, outputting progress as the state changes
+// A timeout of zero means don't wait at all, which is treated as success
+// It takes three parameters, the operation, its initial state and the timeout
+// It returns whether the operation succeeded and an error object, set if it timed out or couldn't be fetched
+func waitForOperation(op asyncOperation, state string, timeout time.Duration) (bool, error) {
+	if timeout <= 0 {
+		_verbose(fmt.Sprintf("not waiting for %s, which is %s", op.name, state))
+		return true, nil
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	fmt.Printf("Waiting up to %s for %s to complete\n", timeout, op.name)
+	fmt.Printf("  => %s: %s\n", time.Since(start).Round(time.Second), state)
+	for {
+		for _, s := range op.succeeded {
+			if state == s {
+				return true, nil
+			}
+		}
+		for _, s := range op.failed {
+			if state == s {
+				return false, nil
+			}
+		}
+		// the last poll is cut short to land on the deadline, so short timeouts still get one
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, fmt.Errorf("%s is still %s after %s", op.name, state, timeout)
+		}
+		time.Sleep(min(pollInterval, remaining))
+		latest, err := op.fetch()
+		if err != nil {
+			return false, err
+		}
+		if latest != state {
+			fmt.Printf("  => %s: %s\n", time.Since(start).Round(time.Second), latest)
+		} else {
+			_verbose(fmt.Sprintf("%s is still %s", op.name, latest))
+		}
+		state = latest
+	}
+}
+
+// waitForRegistration waits for a domain registration to complete
+// It takes four parameters, the domain, the registration ID, its initial state and the timeout
+// It returns whether the registration succeeded and an error object
+func waitForRegistration(domain string, id int64, state string, timeout time.Duration) (bool, error) {
+	return waitForOperation(asyncOperation{
+		name: fmt.Sprintf("registration %d of %s", id, domain),
+		fetch: func() (string, error) {
+			client := getApiClient()
+			r, err := client.Registrar.GetDomainRegistration(context.Background(), config.accountNumber, domain, strconv.FormatInt(id, 10))
+			if err != nil {
+				return "", fmt.Errorf("error fetching registration %d of %s: %s", id, domain, err)
+			}
+			return r.Data.State, nil
+		},
+		succeeded: []string{"registered"},
+		failed:    []string{"failed", "cancelled"},
+	}, state, timeout)
+}
+
+// waitForRenewal waits for a domain renewal to complete
+// It takes four parameters, the domain, the renewal ID, its initial state and the timeout
+// It returns whether the renewal succeeded and an error object
+func waitForRenewal(domain string, id int64, state string, timeout time.Duration) (bool, error) {
+	return waitForOperation(asyncOperation{
+		name: fmt.Sprintf("renewal %d of %s", id, domain),
+		fetch: func() (string, error) {
+			client := getApiClient()
+			r, err := client.Registrar.GetDomainRenewal(context.Background(), config.accountNumber, domain, strconv.FormatInt(id, 10))
+			if err != nil {
+				return "", fmt.Errorf("error fetching renewal %d of %s: %s", id, domain, err)
+			}
+			return r.Data.State, nil
+		},
+		succeeded: []string{"renewed"},
+		failed:    []string{"failed", "cancelled"},
+	}, state, timeout)
+}
+
+// waitForTransfer waits for the transfer of a domain into the account to complete
+// It takes four parameters, the domain, the transfer ID, its initial state and the timeout
+// It returns whether the transfer succeeded and an error object
+func waitForTransfer(domain string, id int64, state string, timeout time.Duration) (bool, error) {
+	return waitForOperation(asyncOperation{
+		name: fmt.Sprintf("transfer %d of %s", id, domain),
+		fetch: func() (string, error) {
+			t, err := getDomainTransfer(domain, id)
+			if err != nil {
+				return "", err
+			}
+			return t.State, nil
+		},
+		succeeded: []string{"transferred"},
+		failed:    []string{"failed", "cancelled"},
+	}, state, timeout)
+}
+
+// waitForRegistrantChange waits for a change of registrant to complete
+// It takes four parameters, the domain, the registrant change ID, its initial state and the timeout
+// It returns whether the change succeeded and an error object
+func waitForRegistrantChange(domain string, id int, state string, timeout time.Duration) (bool, error) {
+	return waitForOperation(asyncOperation{
+		name: fmt.Sprintf("registrant change %d of %s", id, domain),
+		fetch: func() (string, error) {
+			client := getApiClient()
+			r, err := client.Registrar.GetRegistrantChange(context.Background(), config.accountNumber, id)
+			if err != nil {
+				return "", fmt.Errorf("error fetching registrant change %d: %s", id, err)
+			}
+			return r.Data.State, nil
+		},
+		succeeded: []string{"completed"},
+		failed:    []string{"cancelled"},
+	}, state, timeout)
+}
+
+// transferDomainInput is used in place of the library's TransferDomainInput
+// for the same reason as registerDomainInput; auto_renew and whois_privacy are always sent
+type transferDomainInput struct {
+	RegistrantID       int               `json:"registrant_id"`
+	AuthCode           string            `json:"auth_code,omitempty"`
+	EnableWhoisPrivacy bool              `json:"whois_privacy"`
+	EnableAutoRenewal  bool              `json:"auto_renew"`
+	ExtendedAttributes map[string]string `json:"extended_attributes,omitempty"`
+	PremiumPrice       string            `json:"premium_price,omitempty"`
+}
+
+// transferDomain uses the registrar API to start the transfer of a domain into the account
+// It takes two parameters, the domain and the transfer details
+// It returns the transfer object and an error object
+func transferDomain(domain string, input transferDomainInput) (*dnsimple.DomainTransfer, error) {
+	client := getApiClient()
+	path := fmt.Sprintf("/v2/%s/registrar/domains/%s/transfers", config.accountNumber, domain)
+	r := &dnsimple.DomainTransferResponse{}
+	_, err := client.Request(context.Background(), http.MethodPost, path, input, r, nil)
+	if err != nil {
+		_debug(fmt.Sprintf("Error: error transferring domain %s: %s", domain, err))
+		return nil, fmt.Errorf("error transferring domain %s: %s", domain, err)
+	}
+	_debug(fmt.Sprintf("%+v", r.Data))
+	return r.Data, nil
+}
+
+// getDomainTransfer uses the registrar API to fetch the current state of a transfer
+// It takes two parameters, the domain and the transfer ID
+// It returns the transfer object and an error object
+func getDomainTransfer(domain string, transferId int64) (*dnsimple.DomainTransfer, error) {
+	client := getApiClient()
+	r, err := client.Registrar.GetDomainTransfer(context.Background(), config.accountNumber, domain, transferId)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching transfer %d of domain %s: %s", transferId, domain, err)
+	}
+	_debug(fmt.Sprintf("%+v", r.Data))
+	return r.Data, nil
+}
+
+// cancelDomainTransfer uses the registrar API to cancel a pending transfer
+// It takes two parameters, the domain and the transfer ID
+// It returns the transfer object and an error object
+func cancelDomainTransfer(domain string, transferId int64) (*dnsimple.DomainTransfer, error) {
+	client := getApiClient()
+	r, err := client.Registrar.CancelDomainTransfer(context.Background(), config.accountNumber, domain, transferId)
+	if err != nil {
+		return nil, fmt.Errorf("error cancelling transfer %d of domain %s: %s", transferId, domain, err)
+	}
+	return r.Data, nil
+}
+
+// authorizeTransferOut uses the registrar API to allow a domain to be transferred to another registrar
+// DNSimple sends the auth code to the registrant; the API offers no way to read it back
+// It takes one parameter, the domain
+// It returns an error object
+func authorizeTransferOut(domain string) error {
+	client := getApiClient()
+	_, err := client.Registrar.TransferDomainOut(context.Background(), config.accountNumber, domain)
+	if err != nil {
+		return fmt.Errorf("error authorizing transfer out of domain %s: %s", domain, err)
+	}
+	return nil
+}
+
+// domainSettings holds the registrar settings of a domain that can be switched on and off
+type domainSettings struct {
+	AutoRenew    bool
+	WhoisPrivacy bool
+	TransferLock bool
+}
+
+// getDomainSettings fetches the auto renewal, whois privacy and transfer lock settings of a domain
+// It takes one parameter, the domain
+// It returns the settings and an error object
+func getDomainSettings(domain string) (domainSettings, error) {
+	var settings domainSettings
+	d, err := getDomainDetails(domain)
+	if err != nil {
+		return settings, err
+	}
+	settings.AutoRenew = d.AutoRenew
+	settings.WhoisPrivacy = d.PrivateWhois
+
+	client := getApiClient()
+	r, err := client.Registrar.GetDomainTransferLock(context.Background(), config.accountNumber, domain)
+	if err != nil {
+		return settings, fmt.Errorf("error fetching transfer lock of domain %s: %s", domain, err)
+	}
+	settings.TransferLock = r.Data.Enabled
+	return settings, nil
+}
+
+// setDomainSetting uses the registrar API to switch one of a domain's settings on or off
+// It takes three parameters, the domain, the setting (autorenew, whoisprivacy or transferlock) and whether to enable it
+// It returns an error object
+func setDomainSetting(domain string, setting string, enable bool) error {
+	client := getApiClient()
+	ctx := context.Background()
+	var err error
+	switch setting {
+	case "autorenew":
+		if enable {
+			_, err = client.Registrar.EnableDomainAutoRenewal(ctx, config.accountNumber, domain)
+		} else {
+			_, err = client.Registrar.DisableDomainAutoRenewal(ctx, config.accountNumber, domain)
+		}
+	case "whoisprivacy":
+		if enable {
+			_, err = client.Registrar.EnableWhoisPrivacy(ctx, config.accountNumber, domain)
+		} else {
+			_, err = client.Registrar.DisableWhoisPrivacy(ctx, config.accountNumber, domain)
+		}
+	case "transferlock":
+		if enable {
+			_, err = client.Registrar.EnableDomainTransferLock(ctx, config.accountNumber, domain)
+		} else {
+			_, err = client.Registrar.DisableDomainTransferLock(ctx, config.accountNumber, domain)
+		}
+	default:
+		return fmt.Errorf("unknown domain setting %s", setting)
+	}
+	if err != nil {
+		return fmt.Errorf("error changing %s of domain %s: %s", setting, domain, err)
+	}
+	return nil
+}
+
 // getNsFromRegistry uses the registrar API to get a list of the NS records in the registry
 // It takes one parameter, the domain to be queried
 // It returns two parameters, the NS record response and an error object
@@ -381,6 +1069,136 @@ func listNsInRegistry(domain string) {
 	}
 }
 
+// changeNsInRegistry uses the registrar API to replace the delegation NS records in the registry
+// It takes two parameters, the domain and the new set of nameservers
+// It returns two parameters, the NS record response and an error object
+func changeNsInRegistry(domain string, nameservers []string) (*dnsimple.DelegationResponse, error) {
+	client := getApiClient()
+	delegation := dnsimple.Delegation(nameservers)
+	nsResponse, err := client.Registrar.ChangeDomainDelegation(context.Background(), config.accountNumber, domain, &delegation)
+	if err != nil {
+		_debug(fmt.Sprintf("Error: error changing NS records in registry for domain %s: %s", domain, err))
+		return nil, fmt.Errorf("error changing NS records in registry for domain %s: %s", domain, err)
+	}
+	return nsResponse, nil
+}
+
+// checkProposedNameservers runs checks against a set of nameservers before the delegation is changed to them
+// Each address of each nameserver must answer authoritatively for the zone's SOA, the SOA serials
+// should agree, and the apex NS RRset each serves should match the proposed set
+// It takes two parameters, the domain and the proposed nameservers
+// It returns the findings, in the same form as the DS preflight checks
+func checkProposedNameservers(domain string, nameservers []string) []preflightFinding {
+	var findings []preflightFinding
+	proposed := normaliseNameservers(nameservers)
+	serials := make(map[uint32][]string)
+
+	for _, ns := range proposed {
+		addrs, err := getAddressesFromDns(ns)
+		if err != nil {
+			findings = append(findings, preflightFinding{
+				Check:       "ns-authoritative",
+				Severity:    "error",
+				Message:     fmt.Sprintf("Nameserver %s cannot be resolved: %s", ns, err),
+				Explanation: "a nameserver with no address cannot answer for the zone",
+			})
+			continue
+		}
+		for _, addr := range addrs {
+			server := net.JoinHostPort(addr, "53")
+			r, err := doQueryToServer(server, domain, dns.TypeSOA, false)
+			if err != nil || r == nil || !r.Authoritative || r.Rcode != dns.RcodeSuccess {
+				findings = append(findings, preflightFinding{
+					Check:       "ns-authoritative",
+					Severity:    "error",
+					Message:     fmt.Sprintf("Nameserver %s (%s) does not answer authoritatively for %s", ns, addr, domain),
+					Explanation: "delegating to a server that isn't serving the zone makes it lame",
+				})
+				continue
+			}
+			for _, ans := range r.Answer {
+				if soa, ok := ans.(*dns.SOA); ok {
+					serials[soa.Serial] = append(serials[soa.Serial], fmt.Sprintf("%s (%s)", ns, addr))
+				}
+			}
+			findings = append(findings, preflightFinding{Check: "ns-authoritative", Severity: "ok", Message: fmt.Sprintf("Nameserver %s (%s) answers authoritatively for %s", ns, addr, domain)})
+
+			apex, err := doQueryToServer(server, domain, dns.TypeNS, false)
+			if err != nil || apex == nil {
+				continue
+			}
+			var served []string
+			for _, ans := range apex.Answer {
+				if rr, ok := ans.(*dns.NS); ok {
+					served = append(served, rr.Ns)
+				}
+			}
+			served = normaliseNameservers(served)
+			if strings.Join(served, " ") != strings.Join(proposed, " ") {
+				findings = append(findings, preflightFinding{
+					Check:       "apex-ns",
+					Severity:    "warning",
+					Message:     fmt.Sprintf("Nameserver %s (%s) serves apex NS %s, not the proposed %s", ns, addr, strings.Join(served, " "), strings.Join(proposed, " ")),
+					Explanation: "the parent's NS set and the zone's own NS set should match",
+				})
+			} else {
+				findings = append(findings, preflightFinding{Check: "apex-ns", Severity: "ok", Message: fmt.Sprintf("Nameserver %s (%s) serves the proposed apex NS set", ns, addr)})
+			}
+		}
+	}
+
+	switch len(serials) {
+	case 0:
+	case 1:
+		for serial := range serials {
+			findings = append(findings, preflightFinding{Check: "soa-serial", Severity: "ok", Message: fmt.Sprintf("All nameservers serve SOA serial %d", serial)})
+		}
+	default:
+		var parts []string
+		for serial, servers := range serials {
+			parts = append(parts, fmt.Sprintf("%d from %s", serial, strings.Join(servers, ", ")))
+		}
+		sort.Strings(parts)
+		findings = append(findings, preflightFinding{
+			Check:       "soa-serial",
+			Severity:    "warning",
+			Message:     fmt.Sprintf("SOA serials disagree: %s", strings.Join(parts, "; ")),
+			Explanation: "the nameservers are serving different versions of the zone; zone transfers may be failing",
+		})
+	}
+	return findings
+}
+
+// normaliseNameservers lower-cases and fully qualifies a list of nameserver names, and sorts and de-duplicates it
+// so that sets of nameservers from different sources can be compared
+func normaliseNameservers(nameservers []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, ns := range nameservers {
+		n := strings.ToLower(dns.Fqdn(ns))
+		if !seen[n] {
+			seen[n] = true
+			out = append(out, n)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// addDelegationSignerRecordToRegistry uses the registrar API to add a DS record (or key data) to the registry
+// It takes two parameters, the domain and the record
+// It returns the API response and an error object
+func addDelegationSignerRecordToRegistry(domain string, ds dnsimple.DelegationSignerRecord) (*dnsimple.DelegationSignerRecordResponse, error) {
+	client := getApiClient()
+	dsResponse, err := client.Domains.CreateDelegationSignerRecord(context.Background(), config.accountNumber, domain, ds)
+	if err != nil {
+		_debug(fmt.Sprintf("Error: error creating DS record in the registry: %s\n", err))
+		return dsResponse, errors.New(fmt.Sprintf("%s", err))
+	}
+	_debug(fmt.Sprintf("DS record with keytag %s alg %s created in the registry with ID %d", ds.Keytag, ds.Algorithm, dsResponse.Data.ID))
+	return dsResponse, nil
+}
+
 // getDsFromRegistry uses the registrar API to get a list of the DS records in the registry
 // It takes one parameter, the domain to be queried
 // It returns two parameters, the DS record response and an error object
@@ -601,6 +1419,38 @@ func getCdsFromDns(qname string) (map[uint16]dns.CDS, error) {
 	}
 }
 
+// getCdnskeyFromDns looks up CDNSKEY records in DNS
+// It takes one parameter, the domain to be queried
+// It returns a slice of CDNSKEYs and an error object; a nodata response returns neither
+// It expects the response to be either authoritative (AA) or validated (AD), as with getCdsFromDns
+func getCdnskeyFromDns(qname string) ([]dns.CDNSKEY, error) {
+	r, err := doQuery(qname, dns.TypeCDNSKEY)
+	if err != nil || r == nil {
+		_debug(fmt.Sprintf("Error: cannot retrieve CDNSKEY for %s: %s", qname, err))
+		return nil, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		_debug(fmt.Sprintf("Error: no such domain %s", qname))
+		return nil, errors.New("no such domain")
+	}
+	if len(r.Answer) == 0 {
+		_debug("nodata response")
+		return nil, nil
+	}
+	if !(r.Authoritative || r.AuthenticatedData) {
+		_debug("response is neither authoritative nor validated")
+		return nil, errors.New("response is neither authoritative nor validated")
+	}
+	var rrs []dns.CDNSKEY
+	for _, ans := range r.Answer {
+		if rr, ok := ans.(*dns.CDNSKEY); ok {
+			_debug(fmt.Sprintf("got CDNSKEY with keytag %d", rr.KeyTag()))
+			rrs = append(rrs, *rr)
+		}
+	}
+	return rrs, nil
+}
+
 // getDsFromDns looks up DS records in DNS
 // It takes one parameter, the domain to be queried
 // It returns a map of DSs indexed by keytag and an error object
@@ -651,6 +1501,560 @@ func getDsFromDns(qname string) (map[uint16]dns.DS, error) {
 	}
 }
 
+// getDnskeyRrsetFromDns looks up the DNSKEY RRset in DNS along with the RRSIGs covering it
+// It takes one parameter, the domain to be queried
+// It returns the DNSKEY records as a slice of RRs (so they can be passed to RRSIG verification),
+// the RRSIG records covering them, and an error object
+// As with getDnskeyFromDns, it expects the response to be either authoritative (AA) or validated (AD)
+func getDnskeyRrsetFromDns(qname string) ([]dns.RR, []*dns.RRSIG, error) {
+	r, err := doQuery(qname, dns.TypeDNSKEY)
+	if err != nil || r == nil {
+		_debug(fmt.Sprintf("Error: cannot retrieve keys for %s: %s", qname, err))
+		return nil, nil, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		_debug(fmt.Sprintf("Error: no such domain %s", qname))
+		return nil, nil, errors.New("no such domain")
+	}
+	if !(r.Authoritative || r.AuthenticatedData) {
+		_debug("response is neither authoritative nor validated")
+		return nil, nil, errors.New("response is neither authoritative nor validated")
+	}
+
+	var keys []dns.RR
+	var sigs []*dns.RRSIG
+	for _, ans := range r.Answer {
+		switch rr := ans.(type) {
+		case *dns.DNSKEY:
+			_debug(fmt.Sprintf("got DNSKEY with keytag %d and flags %d", rr.KeyTag(), rr.Flags))
+			keys = append(keys, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				_debug(fmt.Sprintf("got RRSIG with keytag %d and algorithm %d", rr.KeyTag, rr.Algorithm))
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	return keys, sigs, nil
+}
+
+// getParentZone works out the zone in which the delegation for the domain lives
+// It takes one parameter, the domain whose parent is required
+// It returns the name of the parent zone and an error object
+// The SOA for the parent name is looked up; if the parent name is not itself a zone apex
+// the SOA in the authority section of the response gives us the enclosing zone
+func getParentZone(domain string) (string, error) {
+	labels := dns.SplitDomainName(domain)
+	if len(labels) < 2 {
+		return ".", nil
+	}
+	parent := dns.Fqdn(strings.Join(labels[1:], "."))
+	r, err := doQuery(parent, dns.TypeSOA)
+	if err != nil || r == nil {
+		_debug(fmt.Sprintf("Error: cannot retrieve SOA for %s: %s", parent, err))
+		return "", fmt.Errorf("cannot retrieve SOA for %s: %s", parent, err)
+	}
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			_debug(fmt.Sprintf("parent zone of %s is %s", domain, soa.Hdr.Name))
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no SOA found for %s", parent)
+}
+
+// getAuthServersForZone looks up the nameservers for a zone and their addresses
+// It takes one parameter, the zone to be queried
+// It returns a slice of host:port strings suitable for passing to doQueryToServer, and an error object
+func getAuthServersForZone(zone string) ([]string, error) {
+	r, err := doQuery(zone, dns.TypeNS)
+	if err != nil || r == nil {
+		_debug(fmt.Sprintf("Error: cannot retrieve NS records for %s: %s", zone, err))
+		return nil, fmt.Errorf("cannot retrieve NS records for %s: %s", zone, err)
+	}
+	var servers []string
+	for _, ans := range r.Answer {
+		ns, ok := ans.(*dns.NS)
+		if !ok {
+			continue
+		}
+		addrs, err := getAddressesFromDns(ns.Ns)
+		if err != nil {
+			_debug(fmt.Sprintf("Warning: cannot resolve nameserver %s: %s", ns.Ns, err))
+			continue
+		}
+		for _, addr := range addrs {
+			servers = append(servers, net.JoinHostPort(addr, "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no usable nameservers found for %s", zone)
+	}
+	return servers, nil
+}
+
+// getAddressesFromDns looks up the A and AAAA records for a name
+// It takes one parameter, the name to be queried
+// It returns a slice of address strings and an error object
+func getAddressesFromDns(qname string) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r, err := doQuery(qname, qtype)
+		if err != nil || r == nil {
+			_debug(fmt.Sprintf("Error: cannot retrieve %s records for %s: %s", dns.TypeToString[qtype], qname, err))
+			continue
+		}
+		for _, ans := range r.Answer {
+			switch rr := ans.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", qname)
+	}
+	return addrs, nil
+}
+
+// getDsFromParent looks up the DS records for a domain directly from the parent zone's nameservers
+// rather than via the configured resolver, so that caching doesn't hide what the parent is serving
+// It takes one parameter, the domain to be queried
+// It returns a slice of DS records, the server that answered, and an error object
+// Unlike getDsFromDns, a domain can have several DS records with the same keytag, so they are not keyed
+func getDsFromParent(domain string) ([]dns.DS, string, error) {
+	zone, err := getParentZone(domain)
+	if err != nil {
+		return nil, "", err
+	}
+	servers, err := getAuthServersForZone(zone)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, server := range servers {
+		r, err := doQueryToServer(server, domain, dns.TypeDS, false)
+		if err != nil || r == nil {
+			_debug(fmt.Sprintf("Warning: query for %s/DS to %s failed: %s", domain, server, err))
+			continue
+		}
+		if !r.Authoritative {
+			_debug(fmt.Sprintf("Warning: response for %s/DS from %s is not authoritative", domain, server))
+			continue
+		}
+		var rrs []dns.DS
+		for _, ans := range r.Answer {
+			if ds, ok := ans.(*dns.DS); ok {
+				_debug(fmt.Sprintf("got DS with keytag %d from %s", ds.KeyTag, server))
+				rrs = append(rrs, *ds)
+			}
+		}
+		return rrs, server, nil
+	}
+	return nil, "", fmt.Errorf("none of the nameservers for %s gave an authoritative answer", zone)
+}
+
+// getReferralFromParent asks the parent zone's nameservers directly for the delegation of a domain
+// It takes one parameter, the domain
+// It returns the NS set in the referral, the glue addresses keyed by (lower-cased, fully qualified) nameserver name,
+// the server that answered and an error object
+func getReferralFromParent(domain string) ([]string, map[string][]string, string, error) {
+	zone, err := getParentZone(domain)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	servers, err := getAuthServersForZone(zone)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for _, server := range servers {
+		r, err := doQueryToServer(server, domain, dns.TypeNS, false)
+		if err != nil || r == nil {
+			_debug(fmt.Sprintf("Warning: query for %s/NS to %s failed: %s", domain, server, err))
+			continue
+		}
+		var nameservers []string
+		// a referral carries the NS set in the authority section; allow for the answer section too
+		for _, rr := range append(r.Ns, r.Answer...) {
+			if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, dns.Fqdn(domain)) {
+				nameservers = append(nameservers, ns.Ns)
+			}
+		}
+		if len(nameservers) == 0 {
+			_debug(fmt.Sprintf("Warning: response for %s/NS from %s contains no delegation", domain, server))
+			continue
+		}
+		glue := make(map[string][]string)
+		for _, rr := range r.Extra {
+			switch a := rr.(type) {
+			case *dns.A:
+				name := strings.ToLower(a.Hdr.Name)
+				glue[name] = append(glue[name], a.A.String())
+			case *dns.AAAA:
+				name := strings.ToLower(a.Hdr.Name)
+				glue[name] = append(glue[name], a.AAAA.String())
+			}
+		}
+		return normaliseNameservers(nameservers), glue, server, nil
+	}
+	return nil, nil, "", fmt.Errorf("none of the nameservers for %s returned a delegation for %s", zone, domain)
+}
+
+// isInBailiwick determines whether a nameserver name is at or below the domain, and so needs glue
+func isInBailiwick(ns string, domain string) bool {
+	return dns.IsSubDomain(strings.ToLower(dns.Fqdn(domain)), strings.ToLower(dns.Fqdn(ns)))
+}
+
+// errDsNotRebuilt is returned by makeDsFromDelegationSignerRecord when a registry record held as DNSKEY
+// data can't be turned back into the DS published for it, so it can't be said to match or not
+var errDsNotRebuilt = errors.New("the DS cannot be rebuilt from the registry's key data")
+
+// makeDsFromDelegationSignerRecord converts a registry DS record into a DNS DS record
+// Records held as DNSKEY data (see getTldDnssecInterfaceType) are converted using the record's own digest
+// type, or the configured one if it has none
+// It takes two parameters, the domain (which becomes the owner name) and the registry record
+// It returns the DS record and an error object should any of the fields not parse, wrapping errDsNotRebuilt
+// if the DS can't be rebuilt from key data
+func makeDsFromDelegationSignerRecord(domain string, dsr dnsimple.DelegationSignerRecord) (dns.DS, error) {
+	var ds dns.DS
+	if dsr.Digest == "" && dsr.PublicKey != "" {
+		// registries that take DNSKEY data hold no digest, so compute one from the key
+		digestType := config.dsDigestType
+		if dsr.DigestType != "" {
+			d, err := strconv.ParseUint(dsr.DigestType, 10, 8)
+			if err != nil {
+				return ds, fmt.Errorf("error converting digest type string (%s) to integer: %s", dsr.DigestType, err)
+			}
+			digestType = uint8(d)
+		}
+		key, err := makeDnskeyFromDelegationSignerRecord(domain, dsr)
+		if err != nil {
+			return ds, err
+		}
+		dsRr := key.ToDS(digestType)
+		if dsRr == nil {
+			return ds, fmt.Errorf("%w: cannot compute a digest of type %d from the public key of record %d", errDsNotRebuilt, digestType, dsr.ID)
+		}
+		return *dsRr, nil
+	}
+	keytag, err := strconv.ParseUint(dsr.Keytag, 10, 16)
+	if err != nil {
+		return ds, fmt.Errorf("error converting keytag string (%s) to integer: %s", dsr.Keytag, err)
+	}
+	algorithm, err := strconv.ParseUint(dsr.Algorithm, 10, 8)
+	if err != nil {
+		return ds, fmt.Errorf("error converting algorithm string (%s) to integer: %s", dsr.Algorithm, err)
+	}
+	digestType, err := strconv.ParseUint(dsr.DigestType, 10, 8)
+	if err != nil {
+		return ds, fmt.Errorf("error converting digest type string (%s) to integer: %s", dsr.DigestType, err)
+	}
+	ds.Hdr = dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeDS, Class: dns.ClassINET}
+	ds.KeyTag = uint16(keytag)
+	ds.Algorithm = uint8(algorithm)
+	ds.DigestType = uint8(digestType)
+	ds.Digest = strings.ToUpper(dsr.Digest)
+	return ds, nil
+}
+
+// makeDnskeyFromDelegationSignerRecord rebuilds the DNSKEY held by a registry that takes DNSKEY data
+// The flags aren't held, but change the keytag and digest; registries take keys with the SEP flag,
+// so that's tried first, and where the record has a keytag, it decides between them
+// It takes two parameters, the domain and the registry's record
+// It returns the DNSKEY and an error object, wrapping errDsNotRebuilt if the keytag can't be matched
+func makeDnskeyFromDelegationSignerRecord(domain string, dsr dnsimple.DelegationSignerRecord) (dns.DNSKEY, error) {
+	var key dns.DNSKEY
+	algorithm, err := strconv.ParseUint(dsr.Algorithm, 10, 8)
+	if err != nil {
+		return key, fmt.Errorf("error converting algorithm string (%s) to integer: %s", dsr.Algorithm, err)
+	}
+	for _, flags := range []uint16{257, 256} {
+		key = dns.DNSKEY{Flags: flags, Protocol: 3, Algorithm: uint8(algorithm), PublicKey: dsr.PublicKey}
+		key.Hdr = dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET}
+		if dsr.Keytag == "" || dsr.Keytag == strconv.Itoa(int(key.KeyTag())) {
+			return key, nil
+		}
+	}
+	return key, fmt.Errorf("%w: the public key of record %d does not give its keytag %s", errDsNotRebuilt, dsr.ID, dsr.Keytag)
+}
+
+// formatDs produces the same presentation of a DS record as used by listDsInRegistry
+func formatDs(ds dns.DS) string {
+	return fmt.Sprintf("DS %5d %d %d %s", ds.KeyTag, ds.Algorithm, ds.DigestType, ds.Digest)
+}
+
+// dsKey produces a string uniquely identifying a DS record, for use as a map index when
+// comparing DS record sets from different sources
+func dsKey(ds dns.DS) string {
+	return fmt.Sprintf("%d %d %d %s", ds.KeyTag, ds.Algorithm, ds.DigestType, strings.ToUpper(ds.Digest))
+}
+
+// makeDelegationSignerRecordFromDnskey builds the registry submission for a DNSKEY
+// registries that take DS digests get a DS with the configured digest type; those that take key data
+// get the algorithm and public key
+// It takes two parameters, the DNSKEY and the registry's DNSSEC interface type (see getTldDnssecInterfaceType)
+// It returns the registry DS record
+func makeDelegationSignerRecordFromDnskey(key dns.DNSKEY, interfaceType string) dnsimple.DelegationSignerRecord {
+	if interfaceType == "key" {
+		var delegationSigner dnsimple.DelegationSignerRecord
+		delegationSigner.Keytag = strconv.FormatUint(uint64(key.KeyTag()), 10)
+		delegationSigner.Algorithm = strconv.FormatUint(uint64(key.Algorithm), 10)
+		delegationSigner.PublicKey = key.PublicKey
+		_debug(fmt.Sprintf("DNSKEY data created: %d %d %d %s", key.Flags, key.Protocol, key.Algorithm, key.PublicKey))
+		return delegationSigner
+	}
+	_verbose(fmt.Sprintf("Creating DS record with digest type %s from DNSKEY record", dns.HashToString[config.dsDigestType]))
+	dsRr := key.ToDS(config.dsDigestType)
+	_debug(fmt.Sprintf("DS record created: DS %d %d %d %s", dsRr.KeyTag, dsRr.Algorithm, dsRr.DigestType, dsRr.Digest))
+	return makeDelegationSignerRecordFromDs(*dsRr)
+}
+
+// makeDelegationSignerRecordFromDs converts a DNS DS record into a registry DS record ready for submission
+func makeDelegationSignerRecordFromDs(ds dns.DS) dnsimple.DelegationSignerRecord {
+	var delegationSigner dnsimple.DelegationSignerRecord
+	delegationSigner.Keytag = strconv.FormatUint(uint64(ds.KeyTag), 10)
+	delegationSigner.Algorithm = strconv.FormatUint(uint64(ds.Algorithm), 10)
+	delegationSigner.DigestType = strconv.FormatUint(uint64(ds.DigestType), 10)
+	delegationSigner.Digest = ds.Digest
+	return delegationSigner
+}
+
+// dsMatchesDnskey checks whether a DS record was generated from a DNSKEY
+// It takes two parameters, the DS record and the DNSKEY record
+// It returns two bools; whether the keytag and algorithm match, and whether the digest matches
+func dsMatchesDnskey(ds dns.DS, key *dns.DNSKEY) (bool, bool) {
+	if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+		return false, false
+	}
+	computed := key.ToDS(ds.DigestType)
+	if computed == nil {
+		return true, false
+	}
+	return true, strings.EqualFold(computed.Digest, ds.Digest)
+}
+
+// preflightFinding is the outcome of one of the checks run against a DNSKEY before a DS record for it is added
+// Severity is one of "ok", "warning" or "error"
+type preflightFinding struct {
+	Check       string `json:"check"`
+	Keytag      uint16 `json:"keytag,omitempty"`
+	Severity    string `json:"severity"`
+	Message     string `json:"message"`
+	Explanation string `json:"explanation,omitempty"`
+}
+
+// preflightCheck is a named check run against a DNSKEY before a DS record for it is added
+// the run function is given the DNSKEY, the RRSIGs over the DNSKEY RRset and the existing DS records
+type preflightCheck struct {
+	name string
+	run  func(key dns.DNSKEY, keysetSigs []*dns.RRSIG, existingDs []dns.DS) preflightFinding
+}
+
+// preflightChecks are run, in order, by runPreflightChecks
+var preflightChecks = []preflightCheck{
+	{"key-type", checkKeyIsKsk},
+	{"keyset-signature", checkKeySignsKeyset},
+	{"algorithm-mismatch", checkKeyAlgorithmMatchesDs},
+	{"deprecated-algorithm", checkKeyAlgorithmNotDeprecated},
+	{"revoked-key", checkKeyNotRevoked},
+}
+
+// checkKeyIsKsk warns if the DNSKEY does not have the SEP flag set
+func checkKeyIsKsk(key dns.DNSKEY, keysetSigs []*dns.RRSIG, existingDs []dns.DS) preflightFinding {
+	if key.Flags&dns.SEP == dns.SEP {
+		return preflightFinding{Severity: "ok", Message: fmt.Sprintf("The DNSKEY with keytag %d is a KSK", key.KeyTag())}
+	}
+	return preflightFinding{
+		Severity:    "warning",
+		Message:     fmt.Sprintf("The DNSKEY with keytag %d is a ZSK", key.KeyTag()),
+		Explanation: "DS records normally point at a Key Signing Key; a ZSK may be rolled without the DS being updated",
+	}
+}
+
+// checkKeySignsKeyset warns if the DNSKEY is not one of those signing the DNSKEY RRset
+func checkKeySignsKeyset(key dns.DNSKEY, keysetSigs []*dns.RRSIG, existingDs []dns.DS) preflightFinding {
+	for _, sig := range keysetSigs {
+		if sig.KeyTag == key.KeyTag() && sig.Algorithm == key.Algorithm {
+			return preflightFinding{Severity: "ok", Message: fmt.Sprintf("The DNSKEY record set is signed with the DNSKEY with keytag %d", key.KeyTag())}
+		}
+	}
+	f := preflightFinding{
+		Severity:    "warning",
+		Message:     fmt.Sprintf("The DNSKEY record set is not signed with the DNSKEY with keytag %d", key.KeyTag()),
+		Explanation: "validators can only follow a DS to a key that signs the DNSKEY record set",
+	}
+	for _, ds := range existingDs {
+		if ds.Algorithm == key.Algorithm {
+			f.Explanation = "although it's of the same algorithm as existing DS records, so may be ok if you're pre-publishing"
+		}
+	}
+	return f
+}
+
+// checkKeyAlgorithmMatchesDs warns if there are existing DS records and none share the DNSKEY's algorithm
+func checkKeyAlgorithmMatchesDs(key dns.DNSKEY, keysetSigs []*dns.RRSIG, existingDs []dns.DS) preflightFinding {
+	if len(existingDs) == 0 {
+		return preflightFinding{Severity: "ok", Message: "There are no existing DS records to compare the algorithm with"}
+	}
+	for _, ds := range existingDs {
+		if ds.Algorithm == key.Algorithm {
+			return preflightFinding{Severity: "ok", Message: fmt.Sprintf("The DNSKEY with keytag %d matches the algorithm of existing DS record(s)", key.KeyTag())}
+		}
+	}
+	return preflightFinding{
+		Severity:    "warning",
+		Message:     fmt.Sprintf("The DNSKEY with keytag %d does NOT match algorithm of existing DS record(s)", key.KeyTag()),
+		Explanation: "an algorithm rollover needs the zone to be signed with both algorithms before the DS set changes",
+	}
+}
+
+// checkKeyAlgorithmNotDeprecated flags algorithms that RFC 8624 says must not, or should not, be used for signing
+func checkKeyAlgorithmNotDeprecated(key dns.DNSKEY, keysetSigs []*dns.RRSIG, existingDs []dns.DS) preflightFinding {
+	switch key.Algorithm {
+	case dns.RSAMD5, dns.DSA, dns.DSANSEC3SHA1, dns.ECCGOST:
+		return preflightFinding{
+			Severity:    "error",
+			Message:     fmt.Sprintf("The DNSKEY with keytag %d uses algorithm %d (%s) which must not be used for signing", key.KeyTag(), key.Algorithm, dns.AlgorithmToString[key.Algorithm]),
+			Explanation: "RFC 8624 prohibits signing with this algorithm and many validators treat it as insecure",
+		}
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1:
+		return preflightFinding{
+			Severity:    "warning",
+			Message:     fmt.Sprintf("The DNSKEY with keytag %d uses deprecated algorithm %d (%s)", key.KeyTag(), key.Algorithm, dns.AlgorithmToString[key.Algorithm]),
+			Explanation: "RFC 8624 recommends against signing with SHA-1 based algorithms; consider an algorithm rollover",
+		}
+	}
+	return preflightFinding{Severity: "ok", Message: fmt.Sprintf("The DNSKEY with keytag %d uses algorithm %d (%s)", key.KeyTag(), key.Algorithm, dns.AlgorithmToString[key.Algorithm])}
+}
+
+// checkKeyNotRevoked flags a DNSKEY with the REVOKE flag set
+func checkKeyNotRevoked(key dns.DNSKEY, keysetSigs []*dns.RRSIG, existingDs []dns.DS) preflightFinding {
+	if key.Flags&dns.REVOKE == dns.REVOKE {
+		return preflightFinding{
+			Severity:    "error",
+			Message:     fmt.Sprintf("The DNSKEY with keytag %d has been revoked", key.KeyTag()),
+			Explanation: "a revoked key (RFC 5011) must not be used as a trust anchor, so a DS for it cannot be used",
+		}
+	}
+	return preflightFinding{Severity: "ok", Message: fmt.Sprintf("The DNSKEY with keytag %d has not been revoked", key.KeyTag())}
+}
+
+// runPreflightChecks runs each of the preflightChecks against a DNSKEY
+// It takes three parameters, the DNSKEY, the RRSIGs over the DNSKEY RRset and the existing DS records
+// It returns a finding for every check, including those that passed
+func runPreflightChecks(key dns.DNSKEY, keysetSigs []*dns.RRSIG, existingDs []dns.DS) []preflightFinding {
+	var findings []preflightFinding
+	for _, c := range preflightChecks {
+		f := c.run(key, keysetSigs, existingDs)
+		f.Check = c.name
+		f.Keytag = key.KeyTag()
+		_debug(fmt.Sprintf("check %s on keytag %d: %s: %s", f.Check, f.Keytag, f.Severity, f.Message))
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// getPreflightFindings gathers what the checks need from DNS and the registry and runs them
+// It takes two parameters, the domain and the DNSKEY a DS record is to be added for
+// It returns the findings and an error object
+func getPreflightFindings(domain string, key dns.DNSKEY) ([]preflightFinding, error) {
+	_, sigs, err := getDnskeyRrsetFromDns(domain)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve keyset for domain %s: %s", domain, err)
+	}
+	dsRecords, err := getDsFromRegistry(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch existing DS records from registry for domain %s: %s", domain, err)
+	}
+	var existingDs []dns.DS
+	var skipped []preflightFinding
+	for _, dsr := range dsRecords.Data {
+		ds, err := makeDsFromDelegationSignerRecord(domain, dsr)
+		if errors.Is(err, errDsNotRebuilt) {
+			// the other records can still be checked against
+			skipped = append(skipped, preflightFinding{Check: "existing-ds", Severity: "warning", Message: fmt.Sprintf("Registry record %d is left out of the checks against existing DS records: %s", dsr.ID, err)})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		existingDs = append(existingDs, ds)
+	}
+	return append(runPreflightChecks(key, sigs, existingDs), skipped...), nil
+}
+
+// reportPreflightFindings outputs the findings in the format requested with -output
+// in text, passed checks are only shown with -verbose
+// It takes two parameters, the findings and the operation they relate to (eg "addition") for the text output
+// It returns the number of findings that were warnings and the number that were errors
+func reportPreflightFindings(findings []preflightFinding, operation string) (int, int) {
+	var warnings, errs int
+	var problems []preflightFinding
+	for _, f := range findings {
+		switch f.Severity {
+		case "warning":
+			warnings++
+			problems = append(problems, f)
+		case "error":
+			errs++
+			problems = append(problems, f)
+		default:
+			_verbose(fmt.Sprintf("Check %s passed: %s", f.Check, f.Message))
+		}
+	}
+
+	if *outputFormat == "json" {
+		out, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error encoding findings as JSON: %s\n", err)
+			return warnings, errs
+		}
+		fmt.Fprintln(reportOutput, string(out))
+		return warnings, errs
+	}
+
+	if len(problems) == 0 {
+		_debug("There are no warnings or errors")
+	} else {
+		// errors and warnings are counted separately, so that errors aren't passed off as warnings
+		var counts []string
+		if errs > 0 {
+			counts = append(counts, fmt.Sprintf("%d error(s)", errs))
+		}
+		if warnings > 0 {
+			counts = append(counts, fmt.Sprintf("%d warning(s)", warnings))
+		}
+		fmt.Printf("Found %s for this %s:\n", strings.Join(counts, " and "), operation)
+	}
+	for _, f := range problems {
+		fmt.Printf("  => [%s] %s: %s\n", f.Severity, f.Check, f.Message)
+		if f.Explanation != "" {
+			fmt.Printf("     (%s)\n", f.Explanation)
+		}
+	}
+	return warnings, errs
+}
+
+// preflightAllows is the one policy for acting on preflight findings: errors stop the operation unless
+// -force is given, and warnings are confirmed with the user, unless -force is given or the caller has
+// reason to go ahead regardless (e.g. a published CDS)
+// It takes three parameters, the number of warnings and errors (from reportPreflightFindings) and
+// whether warnings need confirming
+// It returns whether to proceed, and an error object set when errors stop the operation
+func preflightAllows(warnings int, errs int, confirmWarnings bool) (bool, error) {
+	if errs > 0 {
+		if !*forceOperation {
+			return false, fmt.Errorf("%d preflight check(s) failed; use -force to override", errs)
+		}
+		_debug("there are errors, but the -force flag overrides")
+	}
+	if warnings > 0 && confirmWarnings && !*forceOperation && !askUserYesNo("Given the warnings, do you want to proceed?") {
+		return false, nil
+	}
+	return true, nil
+}
+
 // _verbose takes a string and only outputs it if verbosity is requested via the -verbose CLI flag
 func _verbose(msgString string) {
 	if !*verboseOutput {
@@ -756,6 +2160,59 @@ func parseConfigurationFile(file string) (*configparser.ConfigParser, []error) {
 		config.defaultContact = int(defaultContact)
 	}
 
+	tmp, err = p.Get("register", "whoisPrivacy")
+	if err != nil || tmp == "" {
+		_debug("no whois privacy default specified; defaulting to false")
+	} else {
+		config.whoisPrivacy, err = strconv.ParseBool(tmp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error converting whois privacy configuration string (%s) to boolean: %s", tmp, err)
+			os.Exit(1)
+		}
+	}
+
+	tmp, err = p.Get("register", "autoRenew")
+	if err != nil || tmp == "" {
+		_debug("no auto renew default specified; defaulting to false")
+	} else {
+		config.autoRenew, err = strconv.ParseBool(tmp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error converting auto renew configuration string (%s) to boolean: %s", tmp, err)
+			os.Exit(1)
+		}
+	}
+
+	tmp, err = p.Get("renew", "maxSpend")
+	if err != nil || tmp == "" {
+		_debug("no maximum renewal spend specified")
+	} else {
+		config.maxSpend, err = decimal.NewFromString(tmp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error converting maximum spend configuration string (%s) to number: %s", tmp, err)
+			os.Exit(1)
+		}
+	}
+
+	// the API doesn't tell us which currency the account is billed in, and DNSimple prices in US dollars
+	config.currency, err = p.Get("account", "currency")
+	if err != nil || config.currency == "" {
+		_debug("no currency in configuration; defaulting to USD")
+		config.currency = "USD"
+	}
+	config.currency = strings.ToUpper(config.currency)
+
+	config.smtpServer, err = p.Get("alert", "smtpServer")
+	if err != nil || config.smtpServer == "" {
+		_debug("no SMTP server for alerts in configuration; defaulting to localhost:25")
+		config.smtpServer = "localhost:25"
+	}
+
+	config.alertFrom, err = p.Get("alert", "from")
+	if err != nil || config.alertFrom == "" {
+		_debug("no sender address for alerts in configuration; defaulting to dnsimple@localhost")
+		config.alertFrom = "dnsimple@localhost"
+	}
+
 	if errs == nil {
 		return p, errs
 	} else {
@@ -31,13 +31,11 @@ TODO:
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"runtime/debug"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
@@ -64,6 +62,7 @@ func main() {
 
 	// parse the CLI flags
 	flag.Parse()
+	setupOutput()
 
 	// set verbosity if debug is enabled
 	if *debugOutput && !*verboseOutput {
@@ -201,7 +200,15 @@ func checkCDSvsDS(d string, dryrun bool) error {
 				fmt.Printf("DS %d/%d already exists in the registry with ID %d\n", dsTag, ds.Algorithm, dsR.ID)
 				continue
 			} else {
-				delegationSignerRecord, _ := makeDelagationSignerRecordFromCds(ds)
+				if !preflightCdsAddition(d, ds) {
+					fmt.Printf("DS %d/%d addition skipped due to failed checks\n", dsTag, ds.Algorithm)
+					continue
+				}
+				delegationSignerRecord, err := makeDelagationSignerRecordFromCds(d, ds)
+				if err != nil {
+					fmt.Printf("DS %d/%d addition failed: %s\n", dsTag, ds.Algorithm, err)
+					continue
+				}
 				if dryrun {
 					fmt.Printf("= Dryrun, no alterations made\n")
 				} else {
@@ -237,7 +244,17 @@ func checkCDSvsDS(d string, dryrun bool) error {
 						fmt.Printf("Error: DS %d/%d is one of %d that already exist in the registry (ID %d)\n", cdsTag, cds.Algorithm, dsCount, dsR.ID)
 						continue
 					} else {
-						delegationSignerRecord, _ := makeDelagationSignerRecordFromCds(cds)
+						if !preflightCdsAddition(d, cds) {
+							fmt.Printf("DS %d/%d addition skipped due to failed checks\n", cdsTag, cds.Algorithm)
+							additionFailed = true
+							continue
+						}
+						delegationSignerRecord, err := makeDelagationSignerRecordFromCds(d, cds)
+						if err != nil {
+							fmt.Printf("DS %d/%d addition failed: %s\n", cdsTag, cds.Algorithm, err)
+							additionFailed = true
+							continue
+						}
 						client := getApiClient()
 						dsResponse, err := client.Domains.CreateDelegationSignerRecord(context.Background(), config.accountNumber, d, delegationSignerRecord)
 						if err == nil {
@@ -294,22 +311,73 @@ func checkCDSvsDS(d string, dryrun bool) error {
 	return nil
 }
 
-func makeDelagationSignerRecordFromCds(cds dns.CDS) (dnsimple.DelegationSignerRecord, error) {
-	var delegationSigner dnsimple.DelegationSignerRecord
-	delegationSigner.Keytag = strconv.FormatUint(uint64(cds.KeyTag), 10)
-	delegationSigner.Algorithm = strconv.FormatUint(uint64(cds.Algorithm), 10)
-	delegationSigner.DigestType = strconv.FormatUint(uint64(cds.DigestType), 10)
-	delegationSigner.Digest = cds.Digest
-	return delegationSigner, nil
+// preflightCdsAddition runs the DS preflight checks against the published DNSKEY that a CDS record refers to
+// Warnings are reported but, as the CDS has been published deliberately, the addition goes ahead;
+// errors, or a CDS that doesn't match any published DNSKEY, stop the addition unless -force is used
+// It takes two parameters, the domain and the CDS record
+// It returns a bool indicating whether the addition should go ahead
+func preflightCdsAddition(d string, cds dns.CDS) bool {
+	keys, _, err := getDnskeyRrsetFromDns(d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: error retrieving DNSKEY records for %s: %s\n", d, err)
+		return false
+	}
+	var key *dns.DNSKEY
+	for _, rr := range keys {
+		if _, ok := dsMatchesDnskey(cds.DS, rr.(*dns.DNSKEY)); ok {
+			key = rr.(*dns.DNSKEY)
+		}
+	}
+	if key == nil {
+		fmt.Fprintf(os.Stderr, "Error: CDS %d/%d does not match any published DNSKEY\n", cds.KeyTag, cds.Algorithm)
+		return *forceOperation
+	}
+	findings, err := getPreflightFindings(d, *key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return false
+	}
+	warnings, errs := reportPreflightFindings(findings, "addition")
+	proceed, err := preflightAllows(warnings, errs, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	}
+	return proceed
 }
 
-func addDelegationSignerRecordToRegistry(domain string, ds dnsimple.DelegationSignerRecord) (*dnsimple.DelegationSignerRecordResponse, error) {
-	client := getApiClient()
-	dsResponse, err := client.Domains.CreateDelegationSignerRecord(context.Background(), config.accountNumber, domain, ds)
+// makeDelagationSignerRecordFromCds builds the registry submission for a CDS record
+// registries that take DNSKEY data rather than DS digests are given the matching CDNSKEY,
+// or failing that, the matching published DNSKEY
+// It takes two parameters, the domain and the CDS record
+// It returns the registry DS record and an error object
+func makeDelagationSignerRecordFromCds(d string, cds dns.CDS) (dnsimple.DelegationSignerRecord, error) {
+	interfaceType, err := getTldDnssecInterfaceType(d)
 	if err != nil {
-		_debug(fmt.Sprintf("Error: error creating DS record in the registry: %s\n", err))
-		return dsResponse, errors.New(fmt.Sprintf("%s", err))
+		return dnsimple.DelegationSignerRecord{}, fmt.Errorf("cannot determine whether the registry takes DS or DNSKEY data: %s", err)
+	}
+	if interfaceType != "key" {
+		return makeDelegationSignerRecordFromDs(cds.DS), nil
+	}
+
+	cdnskeys, err := getCdnskeyFromDns(d)
+	if err != nil {
+		return dnsimple.DelegationSignerRecord{}, fmt.Errorf("error retrieving CDNSKEY records for %s: %s", d, err)
+	}
+	for _, cdnskey := range cdnskeys {
+		if _, ok := dsMatchesDnskey(cds.DS, &cdnskey.DNSKEY); ok {
+			_verbose(fmt.Sprintf("Using CDNSKEY %d for CDS %d/%d", cdnskey.KeyTag(), cds.KeyTag, cds.Algorithm))
+			return makeDelegationSignerRecordFromDnskey(cdnskey.DNSKEY, interfaceType), nil
+		}
+	}
+	keys, _, err := getDnskeyRrsetFromDns(d)
+	if err != nil {
+		return dnsimple.DelegationSignerRecord{}, fmt.Errorf("error retrieving DNSKEY records for %s: %s", d, err)
+	}
+	for _, rr := range keys {
+		if _, ok := dsMatchesDnskey(cds.DS, rr.(*dns.DNSKEY)); ok {
+			_verbose(fmt.Sprintf("Using DNSKEY %d for CDS %d/%d", rr.(*dns.DNSKEY).KeyTag(), cds.KeyTag, cds.Algorithm))
+			return makeDelegationSignerRecordFromDnskey(*rr.(*dns.DNSKEY), interfaceType), nil
+		}
 	}
-	_debug(fmt.Sprintf("DS record with keytag %d alg %d created in the registry with ID %d", ds.Keytag, ds.Algorithm, dsResponse.Data.ID))
-	return dsResponse, nil
+	return dnsimple.DelegationSignerRecord{}, fmt.Errorf("the registry for %s takes DNSKEY data but no CDNSKEY or DNSKEY matches CDS %d/%d", d, cds.KeyTag, cds.Algorithm)
 }
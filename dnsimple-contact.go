@@ -6,35 +6,47 @@ package main
 Copyright (c) 2024 Karl Dyson.
 All rights reserved.
 
-TODO (no particular order):
-* Add creation
-* Add deletion
-* better handling of errors if passed a non-number as a contact ID
-
 */
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime/debug"
-	"strconv"
+	"strings"
+
+	"github.com/dnsimple/dnsimple-go/dnsimple"
 )
 
 // main collects the CLI flags,
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] [action] <domain>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [action] <contact>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Contacts may be given by ID, or by label, e-mail address or a fragment of the name\n")
 		fmt.Fprintf(os.Stderr, "Actions:\n")
 		fmt.Fprintf(os.Stderr, "\tlist:\tlist the contacts in the account\n")
-		fmt.Fprintf(os.Stderr, "\tcreate:\tcreate a contact\n")
-		fmt.Fprintf(os.Stderr, "\tdelete:\tdelete a contact\n")
+		fmt.Fprintf(os.Stderr, "\tcreate:\tcreate a contact, from -file or by prompting for the details\n")
+		fmt.Fprintf(os.Stderr, "\tupdate:\tupdate a contact, from -file or by prompting for the details\n")
+		fmt.Fprintf(os.Stderr, "\tdelete:\tdelete a contact, refusing if it is a domain's registrant unless -force is given\n")
+		fmt.Fprintf(os.Stderr, "\tusage:\tlist the domains whose registrant is the contact\n")
+		fmt.Fprintf(os.Stderr, "\tunused:\tlist the contacts in the account that are not the registrant of any domain\n")
 		fmt.Fprintf(os.Stderr, "\n")
 		flag.PrintDefaults()
 	}
 
+	var contactFile string
+	flag.StringVar(&contactFile, "file", "", "JSON or YAML file of contact details for create or update")
+
 	// parse the CLI flags
 	flag.Parse()
+	setupOutput()
 
 	// set verbosity if debug is enabled
 	if *debugOutput && !*verboseOutput {
@@ -97,25 +109,437 @@ func main() {
 			fmt.Printf("Listing contacts in account %s:\n", config.accountNumber)
 			listContactsInAccount()
 		} else {
-			fmt.Printf("Listing details for contact %s:\n", contact)
-			contactInt, err := strconv.ParseInt(contact, 10, 64)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: error parsing string to integer: %s\n", err)
-				os.Exit(1)
-			}
-			c, e := getContactDetails(contactInt)
+			c, e := findContact(contact)
 			if e != nil {
-				fmt.Fprintf(os.Stderr, "Error: error fetching contact details: %s\n", e)
+				fmt.Fprintf(os.Stderr, "Error: error finding contact: %s\n", e)
 				os.Exit(1)
 			}
+			fmt.Printf("Listing details for contact %d:\n", c.ID)
 			listContactDetails(c)
 		}
-	case "create", "delete":
-		fmt.Println("action not yet implemented")
-		return
+	case "create":
+		err := createContact(contactFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	case "unused":
+		fmt.Printf("Listing contacts in account %s not used by any domain:\n", config.accountNumber)
+		err := listUnusedContacts()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	case "update", "delete", "usage":
+		if contact == "" {
+			fmt.Fprintf(os.Stderr, "Error: a contact must be passed in\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		c, err := findContact(contact)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error finding contact: %s\n", err)
+			os.Exit(1)
+		}
+		contactInt := c.ID
+		switch action {
+		case "update":
+			err = updateContact(contactInt, contactFile)
+		case "delete":
+			err = deleteContact(contactInt)
+		case "usage":
+			fmt.Printf("Listing domains using contact %d:\n", contactInt)
+			err = listContactUsage(contactInt)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "Error: unknown action: %s\n", action)
 		flag.Usage()
 		os.Exit(1)
 	}
 }
+
+// contactField describes one of the editable fields of a contact
+type contactField struct {
+	key      string                          // the field's name in the API and in contact files
+	prompt   string                          // what the user is asked for
+	required bool                            // whether the API insists on it
+	get      func(*dnsimple.Contact) *string // where the value lives in the contact
+}
+
+// contactFields are the editable fields of a contact, in the order they're prompted for
+var contactFields = []contactField{
+	{"label", "Label", false, func(c *dnsimple.Contact) *string { return &c.Label }},
+	{"first_name", "First name", true, func(c *dnsimple.Contact) *string { return &c.FirstName }},
+	{"last_name", "Last name", true, func(c *dnsimple.Contact) *string { return &c.LastName }},
+	{"organization_name", "Organisation", false, func(c *dnsimple.Contact) *string { return &c.Organization }},
+	{"job_title", "Job title", false, func(c *dnsimple.Contact) *string { return &c.JobTitle }},
+	{"address1", "Address line 1", true, func(c *dnsimple.Contact) *string { return &c.Address1 }},
+	{"address2", "Address line 2", false, func(c *dnsimple.Contact) *string { return &c.Address2 }},
+	{"city", "City", true, func(c *dnsimple.Contact) *string { return &c.City }},
+	{"state_province", "State or province", true, func(c *dnsimple.Contact) *string { return &c.StateProvince }},
+	{"postal_code", "Postal code", true, func(c *dnsimple.Contact) *string { return &c.PostalCode }},
+	{"country", "Country (ISO 3166 two letter code)", true, func(c *dnsimple.Contact) *string { return &c.Country }},
+	{"phone", "Phone (E.164, e.g. +441632960000)", true, func(c *dnsimple.Contact) *string { return &c.Phone }},
+	{"fax", "Fax (E.164)", false, func(c *dnsimple.Contact) *string { return &c.Fax }},
+	{"email", "E-mail", true, func(c *dnsimple.Contact) *string { return &c.Email }},
+}
+
+// e164 matches a phone number in E.164 format, once any spaces, dots, dashes and brackets are removed
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// phoneSeparators are the characters people put in phone numbers that E.164 doesn't have
+var phoneSeparators = strings.NewReplacer(" ", "", ".", "", "-", "", "(", "", ")", "")
+
+// isoCountries are the ISO 3166-1 alpha-2 country codes
+var isoCountries = map[string]bool{}
+
+func init() {
+	for _, cc := range strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS
+		BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE
+		EG EH ER ES ET FI FJ FK FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM
+		HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN KP KR KW KY KZ LA LB LC
+		LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ NA
+		NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW
+		SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO
+		TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW`) {
+		isoCountries[cc] = true
+	}
+}
+
+// normaliseContact tidies up a contact's details before validation; upper-casing the country code and
+// stripping separators from phone numbers
+func normaliseContact(c *dnsimple.Contact) {
+	for _, f := range contactFields {
+		v := f.get(c)
+		*v = strings.TrimSpace(*v)
+	}
+	c.Country = strings.ToUpper(c.Country)
+	if c.Phone != "" {
+		c.Phone = phoneSeparators.Replace(c.Phone)
+	}
+	if c.Fax != "" {
+		c.Fax = phoneSeparators.Replace(c.Fax)
+	}
+}
+
+// validateContactField checks the value of one field of a contact
+// It takes two parameters, the field and the value
+// It returns an error object describing what's wrong, or nil if it's valid
+func validateContactField(f contactField, value string) error {
+	if value == "" {
+		if f.required {
+			return fmt.Errorf("%s is required", f.key)
+		}
+		return nil
+	}
+	switch f.key {
+	case "country":
+		if !isoCountries[value] {
+			return fmt.Errorf("%s is not an ISO 3166 country code", value)
+		}
+	case "phone", "fax":
+		if !e164.MatchString(value) {
+			return fmt.Errorf("%s %s is not an E.164 number, such as +441632960000", f.key, value)
+		}
+	case "email":
+		if a, err := mail.ParseAddress(value); err != nil || a.Address != value {
+			return fmt.Errorf("%s is not a valid e-mail address", value)
+		}
+	}
+	return nil
+}
+
+// validateContact checks all the fields of a contact
+// It takes one parameter, the contact
+// It returns a list of the problems found
+func validateContact(c *dnsimple.Contact) []error {
+	var problems []error
+	for _, f := range contactFields {
+		if err := validateContactField(f, *f.get(c)); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+// readContactFile reads contact details from a JSON file, or from a YAML file of simple key: value lines
+// (which is all a contact needs, so we don't pull in a YAML library for it)
+// The keys are those the API uses, e.g. first_name, organization_name, state_province
+// It takes one parameter, the file
+// It returns a map of the fields given and an error object
+func readContactFile(file string) (map[string]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", file, err)
+	}
+	fields := make(map[string]string)
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		scanner := bufio.NewScanner(strings.NewReader(string(b)))
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("error parsing %s line %d: expected key: value", file, n)
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+				value = value[1 : len(value)-1]
+			}
+			fields[strings.TrimSpace(key)] = value
+		}
+	default:
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", file, err)
+		}
+	}
+	for key := range fields {
+		var known bool
+		for _, f := range contactFields {
+			if f.key == key {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("%s has an unknown contact field %s", file, key)
+		}
+	}
+	return fields, nil
+}
+
+// promptForContact asks the user for each field of a contact, offering the current value as a default
+// and asking again for any value that doesn't validate; - clears a field
+// It takes one parameter, the contact, which is updated in place
+// It returns an error object
+func promptForContact(c *dnsimple.Contact) error {
+	if !stdinIsTerminal() {
+		return fmt.Errorf("no contact file given with -file, and no terminal to prompt on")
+	}
+	fmt.Fprintln(promptOutput(), "Press enter to keep the value shown, or enter - to clear it")
+	for _, f := range contactFields {
+		v := f.get(c)
+		for {
+			prompt := f.prompt
+			if *v != "" {
+				prompt += fmt.Sprintf(" [%s]", *v)
+			} else if f.required {
+				prompt += " (required)"
+			}
+			response := askUserString(prompt)
+			switch response {
+			case "":
+				response = *v
+			case "-":
+				response = ""
+			}
+			tmp := dnsimple.Contact{}
+			*f.get(&tmp) = response
+			normaliseContact(&tmp)
+			if err := validateContactField(f, *f.get(&tmp)); err != nil {
+				fmt.Fprintf(promptOutput(), "  => %s\n", err)
+				continue
+			}
+			*v = *f.get(&tmp)
+			break
+		}
+	}
+	return nil
+}
+
+// createContact creates a contact from a file, or by prompting the user, once it validates and the user has confirmed
+// It takes one parameter, the contact file (which may be empty)
+// It returns an error object
+func createContact(file string) error {
+	var c dnsimple.Contact
+	if file != "" {
+		fields, err := readContactFile(file)
+		if err != nil {
+			return err
+		}
+		for _, f := range contactFields {
+			*f.get(&c) = fields[f.key]
+		}
+	} else if err := promptForContact(&c); err != nil {
+		return err
+	}
+	normaliseContact(&c)
+	if problems := validateContact(&c); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "  => %s\n", p)
+		}
+		return fmt.Errorf("the contact details are not valid")
+	}
+
+	fmt.Println("New contact:")
+	listContactDetails(&c)
+	if !*forceOperation && !askUserYesNo("Do you wish to create this contact?") {
+		fmt.Println("Creation aborted")
+		return nil
+	}
+	client := getApiClient()
+	r, err := client.Contacts.CreateContact(context.Background(), config.accountNumber, c)
+	if err != nil {
+		return fmt.Errorf("error creating contact: %s", err)
+	}
+	fmt.Printf("Contact %d created for %s %s\n", r.Data.ID, r.Data.FirstName, r.Data.LastName)
+	return nil
+}
+
+// updateContact updates a contact from a file, or by prompting the user, showing the fields that
+// change and asking for confirmation before submitting
+// It takes two parameters, the contact ID and the contact file (which may be empty); fields not in the
+// file are left as they are
+// It returns an error object
+func updateContact(id int64, file string) error {
+	current, err := getContactDetails(id)
+	if err != nil {
+		return err
+	}
+	updated := *current
+	if file != "" {
+		fields, err := readContactFile(file)
+		if err != nil {
+			return err
+		}
+		for _, f := range contactFields {
+			if value, ok := fields[f.key]; ok {
+				*f.get(&updated) = value
+			}
+		}
+	} else if err := promptForContact(&updated); err != nil {
+		return err
+	}
+	normaliseContact(&updated)
+	if problems := validateContact(&updated); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "  => %s\n", p)
+		}
+		return fmt.Errorf("the contact details are not valid")
+	}
+
+	// only the changed fields are sent, as a map rather than a dnsimple.Contact, whose fields are all
+	// omitempty and so can't be used to clear one
+	changes := make(map[string]string)
+	fmt.Printf("Changes to contact %d:\n", id)
+	for _, f := range contactFields {
+		before, after := *f.get(current), *f.get(&updated)
+		if before != after {
+			fmt.Printf("  => %s: %q => %q\n", f.key, before, after)
+			changes[f.key] = after
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Println("  => none; nothing to do")
+		return nil
+	}
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you wish to make these %d change(s)?", len(changes))) {
+		fmt.Println("Update aborted")
+		return nil
+	}
+	client := getApiClient()
+	path := fmt.Sprintf("/v2/%s/contacts/%d", config.accountNumber, id)
+	_, err = client.Request(context.Background(), http.MethodPatch, path, changes, &dnsimple.ContactResponse{}, nil)
+	if err != nil {
+		return fmt.Errorf("error updating contact %d: %s", id, err)
+	}
+	fmt.Printf("Contact %d updated\n", id)
+	return nil
+}
+
+// deleteContact deletes a contact once the user has confirmed
+// It takes one parameter, the contact ID
+// It returns an error object
+func deleteContact(id int64) error {
+	c, err := getContactDetails(id)
+	if err != nil {
+		return err
+	}
+	listContactDetails(c)
+
+	// the API would refuse to delete a registrant anyway, but saying which domains use it is more helpful
+	domains, err := getDomainsForRegistrant(id)
+	if err != nil {
+		return err
+	}
+	if len(domains) > 0 {
+		fmt.Printf("Contact %d is the registrant of %d domain(s):\n", id, len(domains))
+		for _, d := range domains {
+			fmt.Printf("  => %s\n", d.Name)
+		}
+		if !*forceOperation {
+			return fmt.Errorf("contact %d is in use; change the registrant of its domains first, or use -force to try anyway", id)
+		}
+		fmt.Println("Continuing as -force was given")
+	}
+
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you wish to delete contact %d, %s %s?", id, c.FirstName, c.LastName)) {
+		fmt.Println("Deletion aborted")
+		return nil
+	}
+	client := getApiClient()
+	_, err = client.Contacts.DeleteContact(context.Background(), config.accountNumber, id)
+	if err != nil {
+		return fmt.Errorf("error deleting contact %d: %s", id, err)
+	}
+	fmt.Printf("Contact %d deleted\n", id)
+	return nil
+}
+
+// listContactUsage lists the domains whose registrant is the given contact
+// It takes one parameter, the contact ID
+// It returns an error object
+func listContactUsage(id int64) error {
+	if _, err := getContactDetails(id); err != nil {
+		return err
+	}
+	domains, err := getDomainsForRegistrant(id)
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		fmt.Println("  => none")
+		return nil
+	}
+	for _, d := range domains {
+		fmt.Printf("  => %s (%s)\n", d.Name, d.State)
+	}
+	return nil
+}
+
+// listUnusedContacts lists the contacts in the account that are not the registrant of any domain
+// It takes no parameters
+// It returns an error object
+func listUnusedContacts() error {
+	contacts, err := getContactsInAccount()
+	if err != nil {
+		return err
+	}
+	// one walk through the domains is cheaper than asking about each contact in turn
+	domains, err := getDomainsInAccount("")
+	if err != nil {
+		return err
+	}
+	used := make(map[int64]int)
+	for _, d := range domains {
+		used[d.RegistrantID]++
+	}
+	var unused int
+	for _, c := range contacts {
+		if used[c.ID] == 0 {
+			fmt.Printf("  => %d : %s %s\n", c.ID, c.FirstName, c.LastName)
+			unused++
+		}
+	}
+	if unused == 0 {
+		fmt.Println("  => none")
+	}
+	return nil
+}
@@ -6,23 +6,27 @@ package main
 Copyright (c) 2024 Karl Dyson.
 All rights reserved.
 
-TODO (no particular order):
-* add register functionality
-  * should present a list of contacts and prompt for a contact ID
-  * if only one contact found, offer it as a default
-  * registering a domain should pause last thing before actual registration to confirm the details on screen to the user
-* add renewal functionality
-  * offer the user an opportunity (cli flag?) for period to renew for, default to a year
-
 */
 
 import (
+	"bufio"
 	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/dnsimple/dnsimple-go/dnsimple"
+	"github.com/miekg/dns"
+	"github.com/shopspring/decimal"
 )
 
 // main collects the CLI flags,
@@ -32,8 +36,24 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Actions:\n")
 		fmt.Fprintf(os.Stderr, "\tlist:\tlist the domains in the account\n")
 		fmt.Fprintf(os.Stderr, "\tcheck:\tcheck the availability of the domain for registration\n")
+		fmt.Fprintf(os.Stderr, "\t\tor of a label in each of -tlds, or of the names in -domains, with their prices\n")
 		fmt.Fprintf(os.Stderr, "\tregister:\tregister the domain\n")
-		fmt.Fprintf(os.Stderr, "\trenew:\trenew the domain registration\n")
+		fmt.Fprintf(os.Stderr, "\trenew:\trenew the domain registration, or without a domain, those selected with -match or -domains\n")
+		fmt.Fprintf(os.Stderr, "\ttransfer:\ttransfer the domain in, using the auth code given with -authcode, and wait for it to complete\n")
+		fmt.Fprintf(os.Stderr, "\ttransfer-status:\tshow the state of the transfer given with -transferid\n")
+		fmt.Fprintf(os.Stderr, "\tcancel-transfer:\tcancel the pending transfer given with -transferid\n")
+		fmt.Fprintf(os.Stderr, "\tauthorize-transfer-out:\tunlock the domain for transfer to another registrar and have the auth code sent to the registrant\n")
+		fmt.Fprintf(os.Stderr, "\tauthcode:\tthe same as authorize-transfer-out, as the API can only send the auth code to the registrant\n")
+		fmt.Fprintf(os.Stderr, "\tchange-registrant:\tchange the registrant of the domain to the contact given with -contact, and wait for it to complete\n")
+		fmt.Fprintf(os.Stderr, "\tprovision <spec>:\tcheck, register, delegate and secure the domain in the spec file, resuming from -state\n")
+		fmt.Fprintf(os.Stderr, "\tdecommission:\tretire the domain in phases, saving state between runs in -state\n")
+		fmt.Fprintf(os.Stderr, "\tenable-autorenew, disable-autorenew:\tswitch auto renewal on or off\n")
+		fmt.Fprintf(os.Stderr, "\tenable-whoisprivacy, disable-whoisprivacy:\tswitch whois privacy on or off\n")
+		fmt.Fprintf(os.Stderr, "\trenew-whoisprivacy:\trenew the whois privacy service\n")
+		fmt.Fprintf(os.Stderr, "\tlock, unlock:\tswitch the registrar transfer lock on or off\n")
+		fmt.Fprintf(os.Stderr, "\t\twithout a domain, these act on every domain in the account, or those selected with -match or -domains\n")
+		fmt.Fprintf(os.Stderr, "\texpiring:\treport domains expiring within -days, optionally only those matching <domain>\n")
+		fmt.Fprintf(os.Stderr, "\t\texits 0 if none are, 1 if all of them auto renew, 2 if any don't, 3 on error\n")
 		fmt.Fprintf(os.Stderr, "\n")
 		flag.PrintDefaults()
 	}
@@ -41,11 +61,63 @@ func main() {
 	var period int
 	flag.IntVar(&period, "period", 1, "registration or renewal period")
 
-	var contact int
-	flag.IntVar(&contact, "contact", 0, "contact id")
+	var contact string
+	flag.StringVar(&contact, "contact", "", "contact id, label, e-mail address or name")
+
+	var whoisPrivacy bool
+	flag.BoolVar(&whoisPrivacy, "whoisprivacy", false, "enable whois privacy when registering (default from register.whoisPrivacy in the config)")
+
+	var autoRenew bool
+	flag.BoolVar(&autoRenew, "autorenew", false, "enable auto renewal when registering (default from register.autoRenew in the config)")
+
+	var attributesFile string
+	flag.StringVar(&attributesFile, "attributes", "", "JSON file of TLD extended attributes, rather than prompting for them")
+
+	var authCode string
+	flag.StringVar(&authCode, "authcode", "", "auth code from the current registrar when transferring a domain in")
+
+	var transferId int64
+	flag.Int64Var(&transferId, "transferid", 0, "transfer ID, as output when a transfer is started")
+
+	var timeout time.Duration
+	flag.DurationVar(&timeout, "timeout", 30*time.Minute, "how long to wait for a registration, renewal, transfer or registrant change to complete; 0 to not wait (transfers only wait if this is given)")
+
+	var match string
+	flag.StringVar(&match, "match", "", "when no domain is given, act on the domains in the account whose names contain this")
+
+	var domainsFile string
+	flag.StringVar(&domainsFile, "domains", "", "when no domain is given, act on the domains listed in this file, one per line (- for stdin)")
+
+	var maxSpendString string
+	flag.StringVar(&maxSpendString, "maxspend", "", "maximum total to spend on a renewal (default from renew.maxSpend in the config; 0 for no limit)")
+
+	var days int
+	flag.IntVar(&days, "days", 30, "threshold in days for the expiring report")
+
+	var emailTo string
+	flag.StringVar(&emailTo, "email", "", "e-mail a digest of the expiring report to this address")
+
+	var webhookUrl string
+	flag.StringVar(&webhookUrl, "webhook", "", "post a digest of the expiring report as JSON to this URL")
+
+	var tlds string
+	flag.StringVar(&tlds, "tlds", "", "comma separated list of TLDs to check the label given against")
+
+	var concurrency int
+	flag.IntVar(&concurrency, "concurrency", 4, "number of names to check at once")
+
+	var stateFile string
+	flag.StringVar(&stateFile, "state", "", "workflow state file (default dnsimple-<action>-<domain>.json)")
+
+	var parking string
+	flag.StringVar(&parking, "parking", "", "comma separated parking nameservers to re-delegate to when decommissioning")
+
+	var deleteDomain bool
+	flag.BoolVar(&deleteDomain, "delete", false, "delete the domain from the account at the end of decommissioning")
 
 	// parse the CLI flags
 	flag.Parse()
+	setupOutput()
 
 	// set verbosity if debug is enabled
 	if *debugOutput && !*verboseOutput {
@@ -75,11 +147,18 @@ func main() {
 		errs   []error          // somewhere for errors
 	)
 
+	// the expiring action is run by monitoring, for which 1 means domains are expiring, so failing to get
+	// as far as producing the report exits 3 instead, as it does once under way
+	setupExit := 1
+	if flag.Arg(0) == "expiring" {
+		setupExit = 3
+	}
+
 	// do we need to collect the returned value(s) ..? parsing the config can be done in the func only...?
 	_, errs = parseConfigurationFile(*configFile)
 	if errs != nil {
 		fmt.Fprintf(os.Stderr, "Error: Configuration error(s) while parsing config file (%s)\n%s\n", *configFile, errs)
-		os.Exit(1)
+		os.Exit(setupExit)
 	} else {
 		_verbose(fmt.Sprintf("Configuration loaded from %s", *configFile))
 	}
@@ -98,7 +177,32 @@ func main() {
 		// and a default catching something weird
 		fmt.Fprintf(os.Stderr, "Error: invalid number of CLI parameters\n")
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(setupExit)
+	}
+
+	// flags given on the CLI override the defaults in the configuration
+	var whoisPrivacySet, autoRenewSet, timeoutSet bool
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "whoisprivacy":
+			whoisPrivacySet = true
+		case "autorenew":
+			autoRenewSet = true
+		case "timeout":
+			timeoutSet = true
+		}
+	})
+	if !whoisPrivacySet {
+		whoisPrivacy = config.whoisPrivacy
+	}
+	if !autoRenewSet {
+		autoRenew = config.autoRenew
+	}
+
+	attributes, err := readAttributesFile(attributesFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(setupExit)
 	}
 
 	// some debug to clarify the options we are operating with...
@@ -125,6 +229,33 @@ func main() {
 			listContactDetails(c)
 		}
 	case "check":
+		if tlds != "" || domainsFile != "" {
+			var names []string
+			if tlds != "" {
+				if domain == "" {
+					fmt.Fprintf(os.Stderr, "Error: a label must be passed in to check against -tlds\n")
+					flag.Usage()
+					os.Exit(1)
+				}
+				for _, tld := range strings.Split(tlds, ",") {
+					tld = strings.Trim(strings.TrimSpace(tld), ".")
+					if tld != "" {
+						names = append(names, strings.TrimSuffix(domain, ".")+"."+tld)
+					}
+				}
+			} else {
+				var err error
+				names, err = readDomainsFromFile(domainsFile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+					os.Exit(1)
+				}
+			}
+			if reportDomainAvailability(checkDomainsConcurrently(names, concurrency)) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
 		if domain == "" {
 			fmt.Fprintf(os.Stderr, "Error: a domain must be passed in\n")
 			flag.Usage()
@@ -145,30 +276,88 @@ func main() {
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: error checking pricing details for domain %s: %s\n", domain, err)
 			}
-			fmt.Printf(" is available to register at £%.2f", p.Data.RegistrationPrice)
+			fmt.Printf(" is available to register at %s", formatMoney(p.Data.RegistrationPrice))
 		case false:
 			fmt.Printf(" is NOT available to register")
 		}
 		fmt.Println()
 	case "renew":
+		maxSpend := config.maxSpend
+		if maxSpendString != "" {
+			var err error
+			maxSpend, err = decimal.NewFromString(maxSpendString)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid maximum spend %s: %s\n", maxSpendString, err)
+				os.Exit(1)
+			}
+		}
 		if domain == "" {
-			fmt.Fprintf(os.Stderr, "Error: a domain must be passed in\n")
-			flag.Usage()
-			os.Exit(1)
+			if match == "" && domainsFile == "" {
+				fmt.Fprintf(os.Stderr, "Error: a domain must be passed in, or a set of domains selected with -match or -domains\n")
+				flag.Usage()
+				os.Exit(1)
+			}
+			domains, err := selectDomains(domain, match, domainsFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
+			if renewDomains(domains, period, maxSpend, timeout) > 0 {
+				os.Exit(1)
+			}
+			return
 		}
 		p, err := getDomainPrice(domain)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: error checking pricing details for domain %s: %s\n", domain, err)
+			os.Exit(1)
 		}
-		if(askUserYesNo(fmt.Sprintf("Do you wish to renew %s for 1 year for £%.2f ?", domain, p.Data.RenewalPrice))) {
-			client := getApiClient()
-
-			renewalResponse, err := client.Registrar.RenewDomain(context.Background(), config.accountNumber, domain, &dnsimple.RenewDomainInput{Period: period,})
-			if(err != nil) {
-				fmt.Fprintf(os.Stderr, "Error: error renewing domain: %s\n", err)
+		d, err := getDomainDetails(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		c, err := getContactDetails(d.RegistrantID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		cost := p.Data.RenewalPrice.Mul(decimal.NewFromInt(int64(period)))
+		fmt.Printf("Renewal summary for %s:\n", domain)
+		fmt.Printf("\tDomain.......: %s\n", domain)
+		fmt.Printf("\tExpires At...: %s %s\n", d.ExpiresAt, daysToString(d.ExpiresAt))
+		fmt.Printf("\tPeriod.......: %d year(s)\n", period)
+		fmt.Printf("\tPrice........: %s per year\n", formatMoney(p.Data.RenewalPrice))
+		fmt.Printf("\tAuto Renew...: %v\n", d.AutoRenew)
+		fmt.Printf("\tPrivate Whois: %v\n", d.PrivateWhois)
+		fmt.Println("Registrant:")
+		listContactDetails(c)
+		fmt.Println()
+		if maxSpend.IsPositive() && cost.GreaterThan(maxSpend) {
+			fmt.Fprintf(os.Stderr, "Error: renewal would cost %s, which is more than the maximum spend of %s\n", formatMoney(cost), formatMoney(maxSpend))
+			os.Exit(1)
+		}
+		var premiumPrice string
+		if p.Data.Premium {
+			fmt.Printf("%s is a premium domain\n", domain)
+			premiumPrice = p.Data.RenewalPrice.String()
+		}
+		if askUserYesNo(fmt.Sprintf("Do you wish to renew %s for %d year(s) for %s ?", domain, period, formatMoney(cost))) {
+			renewal, err := renewDomain(domain, period, premiumPrice)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%d: Domain %d renewal for %d year. %s\n", renewal.ID, renewal.DomainID, renewal.Period, renewal.State)
+			ok, err := waitForRenewal(domain, renewal.ID, renewal.State, timeout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: renewal of %s did not succeed\n", domain)
 				os.Exit(1)
 			}
-			fmt.Printf("%d: Domain %d renewed for %d year. %s\n", renewalResponse.Data.ID, renewalResponse.Data.DomainID, renewalResponse.Data.Period, renewalResponse.Data.State)
 			return
 		} else {
 			fmt.Println("Renewal aborted")
@@ -179,42 +368,1731 @@ func main() {
 			flag.Usage()
 			os.Exit(1)
 		}
-		if contact == 0 {
-			if config.defaultContact != 0 {
-				contact = config.defaultContact
-			} else {
-				fmt.Fprintf(os.Stderr, "Error: a contact ID is needed\n")
-				flag.Usage()
-				os.Exit(1)
-			}
+		contact, err := resolveRegistrant(contact)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
 		}
 
-		p, err := getDomainPrice(domain)
+		registration, err := registerDomainWithChecks(domain, contact, period, whoisPrivacy, autoRenew, attributes)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: error checking pricing details for domain %s: %s\n", domain, err)
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
 		}
-
-		c, err := getContactDetails(int64(contact))
+		if registration == nil {
+			return
+		}
+		ok, err := waitForRegistration(domain, registration.ID, registration.State, timeout)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: error checking contact details %d: %s\n", contact, err)
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
 		}
-		contactName := c.FirstName + " " + c.LastName
-
-		if(askUserYesNo(fmt.Sprintf("Do you wish to register %s to %s for %d years for £%.2f", domain, contactName, period, p.Data.RegistrationPrice))) {
-			client := getApiClient()
-
-			registrationResponse, err := client.Registrar.RegisterDomain(context.Background(), config.accountNumber, domain, &dnsimple.RegisterDomainInput{RegistrantID: contact, EnableWhoisPrivacy: false, EnableAutoRenewal: false,})
-			if(err != nil) {
-				fmt.Fprintf(os.Stderr, "Error: error registering domain: %s\n", err)
-				os.Exit(1)
-			}
-			fmt.Printf("%d: Domain %d registered to %d for %d year. %s\n", registrationResponse.Data.ID, registrationResponse.Data.DomainID, registrationResponse.Data.RegistrantID, registrationResponse.Data.Period, registrationResponse.Data.State)
+		if !ok {
+			os.Exit(1)
 		}
-
 		return
+	case "transfer":
+		if domain == "" {
+			fmt.Fprintf(os.Stderr, "Error: a domain must be passed in\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if authCode == "" {
+			fmt.Fprintf(os.Stderr, "Error: an auth code from the current registrar must be passed in with -authcode\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		contact, err := resolveRegistrant(contact)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		// transfers normally take days, so the default timeout would only ever fail; wait only if asked to
+		if !timeoutSet {
+			timeout = 0
+		}
+		ok, err := transferDomainWithChecks(domain, contact, authCode, whoisPrivacy, autoRenew, attributes, timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	case "transfer-status", "cancel-transfer":
+		if domain == "" || transferId == 0 {
+			fmt.Fprintf(os.Stderr, "Error: a domain must be passed in, and a transfer ID with -transferid\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		var t *dnsimple.DomainTransfer
+		var err error
+		if action == "cancel-transfer" {
+			if !askUserYesNo(fmt.Sprintf("Do you wish to cancel transfer %d of %s?", transferId, domain)) {
+				fmt.Println("Cancellation aborted")
+				return
+			}
+			t, err = cancelDomainTransfer(domain, transferId)
+		} else {
+			t, err = getDomainTransfer(domain, transferId)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		listTransferDetails(t)
+	case "authorize-transfer-out", "authcode":
+		if domain == "" {
+			fmt.Fprintf(os.Stderr, "Error: a domain must be passed in\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		d, err := getDomainDetails(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		c, err := getContactDetails(d.RegistrantID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		// the API has no way to read back the auth code; authorizing the transfer out is what causes
+		// DNSimple to send it to the registrant, so both actions do the same thing
+		if !askUserYesNo(fmt.Sprintf("Do you wish to authorize transfer out of %s? The auth code will be e-mailed to %s", domain, c.Email)) {
+			fmt.Println("Authorization aborted")
+			return
+		}
+		err = authorizeTransferOut(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Transfer out of %s authorized; the auth code has been sent to %s\n", domain, c.Email)
+	case "enable-autorenew", "disable-autorenew", "enable-whoisprivacy", "disable-whoisprivacy", "lock", "unlock", "renew-whoisprivacy":
+		domains, err := selectDomains(domain, match, domainsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		if len(domains) == 0 {
+			switch {
+			case domainsFile != "":
+				fmt.Fprintf(os.Stderr, "Error: no domains are listed in %s\n", domainsFile)
+			case match != "":
+				fmt.Fprintf(os.Stderr, "Error: no domains in account %s match [%s]\n", config.accountNumber, match)
+			default:
+				fmt.Fprintf(os.Stderr, "Error: there are no domains in account %s\n", config.accountNumber)
+			}
+			os.Exit(1)
+		}
+		if domain == "" && !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you wish to %s %d domain(s)?", action, len(domains))) {
+			fmt.Println("Aborted")
+			return
+		}
+		var failed int
+		if action == "renew-whoisprivacy" {
+			failed = renewWhoisPrivacyForDomains(domains)
+		} else {
+			setting, enable := settingForAction(action)
+			failed = changeDomainSetting(domains, setting, enable)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+	case "expiring":
+		os.Exit(reportExpiringDomains(domain, days, emailTo, webhookUrl))
+	case "change-registrant":
+		if domain == "" {
+			fmt.Fprintf(os.Stderr, "Error: a domain must be passed in\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		contact, err := resolveRegistrant(contact)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		ok, err := changeRegistrant(domain, contact, attributes, timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	case "provision":
+		// the second argument is the spec file rather than a domain
+		if domain == "" {
+			fmt.Fprintf(os.Stderr, "Error: a provisioning spec file must be passed in\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		err := provisionDomain(domain, stateFile, timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	case "decommission":
+		if domain == "" {
+			fmt.Fprintf(os.Stderr, "Error: a domain must be passed in\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		var parkingNameservers []string
+		for _, ns := range strings.Split(parking, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				parkingNameservers = append(parkingNameservers, ns)
+			}
+		}
+		if stateFile == "" {
+			stateFile = fmt.Sprintf("dnsimple-decommission-%s.json", strings.TrimSuffix(domain, "."))
+		}
+		complete, err := decommissionDomain(domain, parkingNameservers, deleteDomain, stateFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		// a run that stops part way, to wait or because a step wasn't confirmed, needs re-running
+		if !complete {
+			os.Exit(2)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "Error: unknown action: %s\n", action)
 		flag.Usage()
 		os.Exit(1)
 	}
 }
+
+// registerDomainWithChecks registers a domain once it's confirmed as available, the TLD's requirements
+// are met, any premium price has been accepted, and the user has confirmed the details
+// It takes six parameters, the domain, the registrant contact ID, the period in years, whether to enable
+// whois privacy and auto renewal, and any extended attribute values already supplied
+// It returns the registration (nil if the user aborted) and an error object
+func registerDomainWithChecks(domain string, contact int, period int, whoisPrivacy bool, autoRenew bool, suppliedAttributes map[string]string) (*dnsimple.DomainRegistration, error) {
+	tld, err := getTldForDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	if !tld.RegistrationEnabled {
+		return nil, fmt.Errorf("registration is not available for .%s domains", tld.Tld)
+	}
+	if tld.MinimumRegistration > period {
+		return nil, fmt.Errorf(".%s domains must be registered for at least %d years", tld.Tld, tld.MinimumRegistration)
+	}
+	if whoisPrivacy && !tld.WhoisPrivacy {
+		fmt.Printf("Warning: whois privacy is not available for .%s domains, so will not be enabled\n", tld.Tld)
+		whoisPrivacy = false
+	}
+	if !autoRenew && tld.AutoRenewOnly {
+		fmt.Printf("Warning: .%s domains can only be registered with auto renewal, so it will be enabled\n", tld.Tld)
+		autoRenew = true
+	}
+
+	r, err := checkDomainStatus(domain)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Data.Available {
+		return nil, fmt.Errorf("%s is NOT available to register", domain)
+	}
+
+	p, err := getDomainPrice(domain)
+	if err != nil {
+		return nil, fmt.Errorf("error checking pricing details for domain %s: %s", domain, err)
+	}
+	var premiumPrice string
+	if r.Data.Premium {
+		fmt.Printf("%s is a premium domain; registration costs %s per year\n", domain, formatMoney(p.Data.RegistrationPrice))
+		if !askUserYesNo("Do you accept the premium price?") {
+			fmt.Println("Registration aborted")
+			return nil, nil
+		}
+		premiumPrice = p.Data.RegistrationPrice.String()
+	}
+
+	attributes, err := collectExtendedAttributes(tld.Tld, suppliedAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := getContactDetails(int64(contact))
+	if err != nil {
+		return nil, fmt.Errorf("error checking contact details %d: %s", contact, err)
+	}
+
+	// prices are per year, so the total is worked out the same way as for renewals
+	cost := p.Data.RegistrationPrice.Mul(decimal.NewFromInt(int64(period)))
+	fmt.Println()
+	fmt.Printf("Registration summary for %s:\n", domain)
+	fmt.Printf("\tDomain.......: %s\n", domain)
+	fmt.Printf("\tPeriod.......: %d year(s)\n", period)
+	fmt.Printf("\tPrice........: %s per year, %s in total\n", formatMoney(p.Data.RegistrationPrice), formatMoney(cost))
+	fmt.Printf("\tPremium......: %v\n", r.Data.Premium)
+	fmt.Printf("\tWhois Privacy: %v\n", whoisPrivacy)
+	fmt.Printf("\tAuto Renew...: %v\n", autoRenew)
+	for name, value := range attributes {
+		fmt.Printf("\tAttribute....: %s = %s\n", name, value)
+	}
+	fmt.Println("Registrant:")
+	listContactDetails(c)
+	fmt.Println()
+	if !askUserYesNo(fmt.Sprintf("Do you wish to register %s to %s %s for %d year(s) for %s", domain, c.FirstName, c.LastName, period, formatMoney(cost))) {
+		fmt.Println("Registration aborted")
+		return nil, nil
+	}
+
+	registration, err := registerDomain(domain, registerDomainInput{
+		RegistrantID:       contact,
+		Period:             period,
+		EnableWhoisPrivacy: whoisPrivacy,
+		EnableAutoRenewal:  autoRenew,
+		ExtendedAttributes: attributes,
+		PremiumPrice:       premiumPrice,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("%d: Domain %d registration to %d for %d year. %s\n", registration.ID, registration.DomainID, registration.RegistrantID, registration.Period, registration.State)
+	return registration, nil
+}
+
+// collectExtendedAttributes gathers the extended attributes a TLD takes
+// It takes two parameters, the TLD and any values already supplied (which may be nil)
+// It returns a map of attribute names to values and an error object
+func collectExtendedAttributes(tld string, supplied map[string]string) (map[string]string, error) {
+	client := getApiClient()
+	r, err := client.Tlds.GetTldExtendedAttributes(context.Background(), tld)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching extended attributes for .%s: %s", tld, err)
+	}
+	if len(r.Data) == 0 {
+		_debug(fmt.Sprintf(".%s has no extended attributes", tld))
+		return nil, nil
+	}
+	return promptForExtendedAttributes(r.Data, "."+tld+" domains", supplied)
+}
+
+// readAttributesFile reads extended attribute values from a JSON object of names to values
+// It takes one parameter, the file, which may be empty
+// It returns the attribute values (nil if no file was given) and an error object
+func readAttributesFile(file string) (map[string]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", file, err)
+	}
+	supplied := make(map[string]string)
+	if err := json.Unmarshal(b, &supplied); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", file, err)
+	}
+	return supplied, nil
+}
+
+// promptForExtendedAttributes gathers values for extended attributes from those supplied, prompting the
+// user for any that aren't; if values were supplied at all, only missing required attributes are prompted for
+// Where permitted values are listed for an attribute, the value is checked against them
+// It takes three parameters, the attributes, what they're for (for error messages) and the supplied values (which may be nil)
+// It returns a map of attribute names to values and an error object
+func promptForExtendedAttributes(attrs []dnsimple.TldExtendedAttribute, purpose string, supplied map[string]string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	for _, attr := range attrs {
+		value, ok := supplied[attr.Name]
+		if !ok {
+			if !attr.Required && supplied != nil {
+				continue
+			}
+			fmt.Printf("Extended attribute %s: %s\n", attr.Name, attr.Description)
+			for i, o := range attr.Options {
+				fmt.Printf("  %d) %s: %s %s\n", i+1, o.Value, o.Title, o.Description)
+			}
+			prompt := fmt.Sprintf("Value for %s", attr.Name)
+			if !attr.Required {
+				prompt += " (optional; press enter to skip)"
+			}
+			value = askUserString(prompt)
+			// allow options to be picked by number
+			if n, err := strconv.Atoi(value); err == nil && n >= 1 && n <= len(attr.Options) {
+				value = attr.Options[n-1].Value
+			}
+		}
+		if value == "" {
+			if attr.Required {
+				return nil, fmt.Errorf("extended attribute %s is required for %s", attr.Name, purpose)
+			}
+			continue
+		}
+		if len(attr.Options) > 0 {
+			var valid bool
+			for _, o := range attr.Options {
+				if o.Value == value {
+					valid = true
+				}
+			}
+			if !valid {
+				return nil, fmt.Errorf("%s is not a valid value for extended attribute %s", value, attr.Name)
+			}
+		}
+		attributes[attr.Name] = value
+	}
+	return attributes, nil
+}
+
+// resolveRegistrant works out the contact to use as a registrant; the one given on the CLI, then the
+// default from the configuration, and finally, if neither is set, the one the user picks from a menu
+// It takes one parameter, the contact passed on the CLI (or empty); an ID, label, e-mail address or name
+// It returns the contact ID and an error object
+func resolveRegistrant(contact string) (int, error) {
+	if contact != "" {
+		c, err := findContact(contact)
+		if err != nil {
+			return 0, err
+		}
+		return int(c.ID), nil
+	}
+	if config.defaultContact != 0 {
+		return config.defaultContact, nil
+	}
+	c, err := pickContact()
+	if err != nil {
+		return 0, err
+	}
+	return int(c.ID), nil
+}
+
+// transferDomainWithChecks starts the transfer of a domain into the account, once the TLD's requirements
+// are met, any premium price has been accepted, and the user has confirmed the details, and then waits
+// for the transfer to complete
+// It takes seven parameters, the domain, the registrant contact ID, the auth code, whether to enable
+// whois privacy and auto renewal, an optional file of extended attributes, and how long to wait
+// It returns whether the transfer completed successfully and an error object
+func transferDomainWithChecks(domain string, contact int, authCode string, whoisPrivacy bool, autoRenew bool, suppliedAttributes map[string]string, timeout time.Duration) (bool, error) {
+	tld, err := getTldForDomain(domain)
+	if err != nil {
+		return false, err
+	}
+	if whoisPrivacy && !tld.WhoisPrivacy {
+		fmt.Printf("Warning: whois privacy is not available for .%s domains, so will not be enabled\n", tld.Tld)
+		whoisPrivacy = false
+	}
+	if !autoRenew && tld.AutoRenewOnly {
+		fmt.Printf("Warning: .%s domains can only be held with auto renewal, so it will be enabled\n", tld.Tld)
+		autoRenew = true
+	}
+
+	p, err := getDomainPrice(domain)
+	if err != nil {
+		return false, fmt.Errorf("error checking pricing details for domain %s: %s", domain, err)
+	}
+	var premiumPrice string
+	if p.Data.Premium {
+		fmt.Printf("%s is a premium domain; transfer costs %s\n", domain, formatMoney(p.Data.TransferPrice))
+		if !askUserYesNo("Do you accept the premium price?") {
+			fmt.Println("Transfer aborted")
+			return false, nil
+		}
+		premiumPrice = p.Data.TransferPrice.String()
+	}
+
+	attributes, err := collectExtendedAttributes(tld.Tld, suppliedAttributes)
+	if err != nil {
+		return false, err
+	}
+
+	c, err := getContactDetails(int64(contact))
+	if err != nil {
+		return false, fmt.Errorf("error checking contact details %d: %s", contact, err)
+	}
+
+	fmt.Println()
+	fmt.Printf("Transfer summary for %s:\n", domain)
+	fmt.Printf("\tDomain.......: %s\n", domain)
+	fmt.Printf("\tPrice........: %s\n", formatMoney(p.Data.TransferPrice))
+	fmt.Printf("\tPremium......: %v\n", p.Data.Premium)
+	fmt.Printf("\tWhois Privacy: %v\n", whoisPrivacy)
+	fmt.Printf("\tAuto Renew...: %v\n", autoRenew)
+	for name, value := range attributes {
+		fmt.Printf("\tAttribute....: %s = %s\n", name, value)
+	}
+	fmt.Println("Registrant:")
+	listContactDetails(c)
+	fmt.Println()
+	if !askUserYesNo(fmt.Sprintf("Do you wish to transfer %s to %s %s for %s", domain, c.FirstName, c.LastName, formatMoney(p.Data.TransferPrice))) {
+		fmt.Println("Transfer aborted")
+		return false, nil
+	}
+
+	t, err := transferDomain(domain, transferDomainInput{
+		RegistrantID:       contact,
+		AuthCode:           authCode,
+		EnableWhoisPrivacy: whoisPrivacy,
+		EnableAutoRenewal:  autoRenew,
+		ExtendedAttributes: attributes,
+		PremiumPrice:       premiumPrice,
+	})
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("Transfer %d of %s started. %s\n", t.ID, domain, t.State)
+
+	// transfers can take days, so give up waiting after the timeout, leaving the transfer in place
+	ok, err := waitForTransfer(domain, t.ID, t.State, timeout)
+	if err != nil {
+		return false, fmt.Errorf("%s; check on it later with the transfer-status action and -transferid %d", err, t.ID)
+	}
+	if timeout > 0 {
+		t, err = getDomainTransfer(domain, t.ID)
+		if err != nil {
+			return false, err
+		}
+		listTransferDetails(t)
+	}
+	return ok, nil
+}
+
+// listTransferDetails takes a transfer object and outputs pretty details for it
+func listTransferDetails(t *dnsimple.DomainTransfer) {
+	fmt.Printf("\tID...........: %d\n", t.ID)
+	fmt.Printf("\tDomain ID....: %d\n", t.DomainID)
+	fmt.Printf("\tRegistrant ID: %d\n", t.RegistrantID)
+	fmt.Printf("\tState........: %s\n", t.State)
+	fmt.Printf("\tStatus.......: %s\n", t.StatusDescription)
+	fmt.Printf("\tAuto Renew...: %v\n", t.AutoRenew)
+	fmt.Printf("\tPrivate Whois: %v\n", t.WhoisPrivacy)
+	fmt.Printf("\tCreated At...: %s\n", t.CreatedAt)
+	fmt.Printf("\tUpdated At...: %s\n", t.UpdatedAt)
+}
+
+// selectDomains works out which domains a bulk action applies to; the domain given, or if none was,
+// those listed in the file, or failing that the domains in the account whose names contain the match
+// string (all of them if that's empty too)
+// It takes three parameters, the domain, the match string and the file of domains
+// It returns the list of domain names and an error object
+func selectDomains(domain string, match string, file string) ([]string, error) {
+	if domain != "" {
+		return []string{domain}, nil
+	}
+	if file != "" {
+		return readDomainsFromFile(file)
+	}
+	d, err := getDomainsInAccount(match)
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	for _, dr := range d {
+		domains = append(domains, dr.Name)
+	}
+	return domains, nil
+}
+
+// readDomainsFromFile reads a list of domains, one per line, ignoring blank lines and # comments
+// It takes one parameter, the file, which may be - for standard input, in which case prompts are
+// switched to the terminal
+// It returns the list of domain names and an error object
+func readDomainsFromFile(file string) ([]string, error) {
+	f := os.Stdin
+	if file != "-" {
+		var err error
+		f, err = os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %s", file, err)
+		}
+		defer f.Close()
+	}
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, strings.ToLower(strings.TrimSuffix(line, ".")))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", file, err)
+	}
+	// standard input is used up, so any confirmation has to come from the terminal, if there is one
+	if file == "-" {
+		if err := usePromptTerminal(); err != nil {
+			_verbose(fmt.Sprintf("%s; confirmations will need -force", err))
+		}
+	}
+	return domains, nil
+}
+
+// settingForAction maps an action on the CLI to the domain setting it changes and whether it enables it
+// It takes one parameter, the action
+// It returns the setting name and whether the setting is being enabled
+func settingForAction(action string) (string, bool) {
+	switch action {
+	case "enable-autorenew":
+		return "autorenew", true
+	case "disable-autorenew":
+		return "autorenew", false
+	case "enable-whoisprivacy":
+		return "whoisprivacy", true
+	case "disable-whoisprivacy":
+		return "whoisprivacy", false
+	case "lock":
+		return "transferlock", true
+	case "unlock":
+		return "transferlock", false
+	}
+	return "", false
+}
+
+// settingValue picks the named setting out of a domain's settings
+func settingValue(s domainSettings, setting string) bool {
+	switch setting {
+	case "autorenew":
+		return s.AutoRenew
+	case "whoisprivacy":
+		return s.WhoisPrivacy
+	case "transferlock":
+		return s.TransferLock
+	}
+	return false
+}
+
+// changeDomainSetting switches a setting on or off for each of the domains, skipping those already
+// in the wanted state, and then outputs a summary of each domain's setting before and after
+// It takes three parameters, the domains, the setting and whether to enable it
+// It returns the number of domains that couldn't be changed
+func changeDomainSetting(domains []string, setting string, enable bool) int {
+	type result struct {
+		domain string
+		before bool
+		after  bool
+		err    error
+	}
+	var results []result
+	var failed int
+	for _, domain := range domains {
+		r := result{domain: domain}
+		before, err := getDomainSettings(domain)
+		if err == nil {
+			r.before = settingValue(before, setting)
+			r.after = r.before
+			if r.before != enable {
+				_verbose(fmt.Sprintf("changing %s of %s to %v", setting, domain, enable))
+				err = setDomainSetting(domain, setting, enable)
+			}
+		}
+		if err == nil && r.before != enable {
+			after, e := getDomainSettings(domain)
+			err = e
+			r.after = settingValue(after, setting)
+		}
+		if err != nil {
+			failed++
+		}
+		r.err = err
+		results = append(results, r)
+	}
+
+	strwidth := 0
+	for _, r := range results {
+		if len(r.domain) > strwidth {
+			strwidth = len(r.domain)
+		}
+	}
+	fmt.Printf("Summary of %s changes:\n", setting)
+	for _, r := range results {
+		name := r.domain + strings.Repeat(".", (strwidth-len(r.domain)))
+		switch {
+		case r.err != nil:
+			fmt.Printf("  => %-*s; FAILED: %s\n", strwidth, name, r.err)
+		case r.before == r.after:
+			fmt.Printf("  => %-*s; %v (unchanged)\n", strwidth, name, r.after)
+		default:
+			fmt.Printf("  => %-*s; %v => %v\n", strwidth, name, r.before, r.after)
+		}
+	}
+	return failed
+}
+
+// renewWhoisPrivacyForDomains renews the whois privacy service for each of the domains, and
+// outputs a summary of the expiry before and after
+// It takes one parameter, the domains
+// It returns the number of domains that couldn't be renewed
+func renewWhoisPrivacyForDomains(domains []string) int {
+	client := getApiClient()
+	ctx := context.Background()
+	var failed int
+	fmt.Println("Summary of whois privacy renewals:")
+	for _, domain := range domains {
+		before, err := client.Registrar.GetWhoisPrivacy(ctx, config.accountNumber, domain)
+		if err != nil {
+			failed++
+			fmt.Printf("  => %s; FAILED: error fetching whois privacy: %s\n", domain, err)
+			continue
+		}
+		renewal, err := client.Registrar.RenewWhoisPrivacy(ctx, config.accountNumber, domain)
+		if err != nil {
+			failed++
+			fmt.Printf("  => %s; FAILED: error renewing whois privacy: %s\n", domain, err)
+			continue
+		}
+		fmt.Printf("  => %s; expiry %s => %s\n", domain, before.Data.ExpiresOn, renewal.Data.ExpiresOn)
+	}
+	return failed
+}
+
+// expiringDomain is a domain in the expiring report
+type expiringDomain struct {
+	Domain    string `json:"domain"`
+	ExpiresAt string `json:"expires_at"`
+	Days      int    `json:"days"`
+	AutoRenew bool   `json:"auto_renew"`
+	AtRisk    bool   `json:"at_risk"`
+}
+
+// reportExpiringDomains outputs the domains in the account that expire within the threshold, flagging
+// those that won't auto renew as at risk, and optionally sends a digest by e-mail and/or webhook
+// The return value is intended as an exit code for monitoring systems; 0 if no domains are expiring,
+// 1 if they are but all of them will auto renew, 2 if any are at risk, and 3 if the report couldn't be
+// produced; failing to deliver the digest is reported on stderr without hiding the expiry signal
+// It takes four parameters, an optional string to match domain names against, the threshold in days,
+// and the optional e-mail address and webhook URL to send the digest to
+// It returns the exit code
+func reportExpiringDomains(match string, days int, emailTo string, webhookUrl string) int {
+	d, err := getDomainsInAccount(match)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 3
+	}
+
+	// an empty report is [] rather than null in JSON
+	expiring := []expiringDomain{}
+	var atRisk int
+	for _, dr := range d {
+		// domains that are only hosted, not registered, have no expiry
+		if dr.ExpiresAt == "" {
+			continue
+		}
+		left, err := dateToDaysFromNow(dr.ExpiresAt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 3
+		}
+		if left > days {
+			continue
+		}
+		e := expiringDomain{Domain: dr.Name, ExpiresAt: dr.ExpiresAt, Days: left, AutoRenew: dr.AutoRenew, AtRisk: !dr.AutoRenew}
+		if e.AtRisk {
+			atRisk++
+		}
+		expiring = append(expiring, e)
+	}
+	sort.Slice(expiring, func(i, j int) bool { return expiring[i].Days < expiring[j].Days })
+
+	switch *outputFormat {
+	case "json":
+		b, err := json.MarshalIndent(expiring, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error encoding report: %s\n", err)
+			return 3
+		}
+		fmt.Fprintln(reportOutput, string(b))
+	case "csv":
+		w := csv.NewWriter(reportOutput)
+		w.Write([]string{"domain", "expires_at", "days", "auto_renew", "at_risk"})
+		for _, e := range expiring {
+			w.Write([]string{e.Domain, e.ExpiresAt, strconv.Itoa(e.Days), strconv.FormatBool(e.AutoRenew), strconv.FormatBool(e.AtRisk)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error writing report: %s\n", err)
+			return 3
+		}
+	default:
+		fmt.Print(expiringDigest(expiring, days))
+	}
+
+	code := 0
+	if len(expiring) > 0 {
+		code = 1
+	}
+	if atRisk > 0 {
+		code = 2
+	}
+
+	// only bother people when there's something to tell them
+	if len(expiring) > 0 {
+		if emailTo != "" {
+			subject := fmt.Sprintf("%d domain(s) in account %s expire within %d days", len(expiring), config.accountNumber, days)
+			if atRisk > 0 {
+				subject = fmt.Sprintf("%d domain(s) in account %s expire within %d days without auto renewal", atRisk, config.accountNumber, days)
+			}
+			if err := sendEmail(emailTo, subject, expiringDigest(expiring, days)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: digest not delivered: %s\n", err)
+			}
+		}
+		if webhookUrl != "" {
+			payload := map[string]interface{}{
+				"account": config.accountNumber,
+				"days":    days,
+				"at_risk": atRisk,
+				"domains": expiring,
+			}
+			if err := postWebhook(webhookUrl, payload); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: digest not delivered: %s\n", err)
+			}
+		}
+	}
+	return code
+}
+
+// expiringDigest formats the expiring report as text, for output and for e-mailing
+// It takes two parameters, the expiring domains and the threshold in days
+// It returns the text
+func expiringDigest(expiring []expiringDomain, days int) string {
+	if len(expiring) == 0 {
+		return fmt.Sprintf("No domains in account %s expire within %d days\n", config.accountNumber, days)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Domains in account %s expiring within %d days:\n", config.accountNumber, days)
+	strwidth := 0
+	for _, e := range expiring {
+		if len(e.Domain) > strwidth {
+			strwidth = len(e.Domain)
+		}
+	}
+	for _, e := range expiring {
+		name := e.Domain + strings.Repeat(".", (strwidth-len(e.Domain)))
+		risk := ""
+		if e.AtRisk {
+			risk = "; NOT SET TO AUTO RENEW"
+		}
+		fmt.Fprintf(&b, "  => %-*s; expiry: %s (%d days)%s\n", strwidth, name, e.ExpiresAt, e.Days, risk)
+	}
+	return b.String()
+}
+
+// renewalResult is the outcome of renewing one domain in a bulk renewal
+type renewalResult struct {
+	domain string
+	price  decimal.Decimal
+	// the renewal price, as confirmation for premium domains
+	premiumPrice string
+	id           int64
+	state        string
+	err          error
+}
+
+// renewDomains renews a set of domains, after pricing them all up and asking for confirmation of the
+// total, which must be within the maximum spend; each domain is renewed in turn, carrying on past any
+// that fail, and a summary of the results is output at the end
+// It takes four parameters, the domains, the period in years, the maximum spend (0 for no limit) and how
+// long to wait for each renewal to complete
+// It returns the number of domains that couldn't be priced or renewed
+func renewDomains(domains []string, period int, maxSpend decimal.Decimal, timeout time.Duration) int {
+	var results []renewalResult
+	var total decimal.Decimal
+	var failed int
+	for _, domain := range domains {
+		r := renewalResult{domain: domain}
+		p, err := getDomainPrice(domain)
+		if err != nil {
+			r.err = err
+			failed++
+		} else {
+			r.price = p.Data.RenewalPrice.Mul(decimal.NewFromInt(int64(period)))
+			total = total.Add(r.price)
+			if p.Data.Premium {
+				r.premiumPrice = p.Data.RenewalPrice.String()
+			}
+		}
+		results = append(results, r)
+	}
+
+	strwidth := 0
+	for _, r := range results {
+		if len(r.domain) > strwidth {
+			strwidth = len(r.domain)
+		}
+	}
+	fmt.Printf("Renewal estimate for %d domain(s) for %d year(s):\n", len(domains), period)
+	for _, r := range results {
+		name := r.domain + strings.Repeat(".", (strwidth-len(r.domain)))
+		if r.err != nil {
+			fmt.Printf("  => %-*s; UNPRICED, will be skipped: %s\n", strwidth, name, r.err)
+		} else {
+			var premium string
+			if r.premiumPrice != "" {
+				premium = " (premium)"
+			}
+			fmt.Printf("  => %-*s; %s%s\n", strwidth, name, formatMoney(r.price), premium)
+		}
+	}
+	fmt.Printf("Total: %s\n", formatMoney(total))
+
+	if maxSpend.IsPositive() && total.GreaterThan(maxSpend) {
+		fmt.Fprintf(os.Stderr, "Error: renewals would cost %s, which is more than the maximum spend of %s\n", formatMoney(total), formatMoney(maxSpend))
+		return len(domains)
+	}
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you wish to renew %d domain(s) for %d year(s) for %s ?", len(domains)-failed, period, formatMoney(total))) {
+		fmt.Println("Renewal aborted")
+		return 0
+	}
+
+	for i, r := range results {
+		if r.err != nil {
+			continue
+		}
+		_verbose(fmt.Sprintf("renewing %s", r.domain))
+		renewal, err := renewDomain(r.domain, period, r.premiumPrice)
+		if err != nil {
+			results[i].err = err
+			failed++
+			continue
+		}
+		results[i].id = renewal.ID
+		results[i].state = renewal.State
+	}
+
+	// all the renewals are submitted before waiting on any, so they run alongside each other, and
+	// share one deadline rather than each getting the full timeout
+	deadline := time.Now().Add(timeout)
+	for i, r := range results {
+		if r.err != nil {
+			continue
+		}
+		wait := timeout
+		if timeout > 0 {
+			// once the deadline has passed, each remaining renewal still gets one last look
+			wait = max(time.Until(deadline), time.Second)
+		}
+		ok, err := waitForRenewal(r.domain, r.id, r.state, wait)
+		if err == nil && !ok {
+			err = fmt.Errorf("renewal %d did not succeed", r.id)
+		}
+		if err != nil {
+			results[i].err = err
+			failed++
+			continue
+		}
+		if timeout > 0 {
+			results[i].state = "renewed"
+		}
+	}
+
+	fmt.Println("Renewal results:")
+	for _, r := range results {
+		name := r.domain + strings.Repeat(".", (strwidth-len(r.domain)))
+		if r.err != nil {
+			fmt.Printf("  => %-*s; FAILED: %s\n", strwidth, name, r.err)
+		} else {
+			fmt.Printf("  => %-*s; %s\n", strwidth, name, r.state)
+		}
+	}
+	fmt.Printf("%d renewed, %d failed\n", len(domains)-failed, failed)
+	return failed
+}
+
+// availability is the result of checking one name in a bulk check
+type availability struct {
+	Domain            string           `json:"domain"`
+	Available         bool             `json:"available"`
+	Premium           bool             `json:"premium"`
+	RegistrationPrice *decimal.Decimal `json:"registration_price,omitempty"`
+	RenewalPrice      *decimal.Decimal `json:"renewal_price,omitempty"`
+	TransferPrice     *decimal.Decimal `json:"transfer_price,omitempty"`
+	Error             string           `json:"error,omitempty"`
+}
+
+// checkDomainsConcurrently checks the availability and prices of a list of names, several at a time,
+// holding off when the API rate limit is running low
+// It takes two parameters, the names and how many to check at once
+// It returns the results, in the same order as the names
+func checkDomainsConcurrently(names []string, concurrency int) []availability {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]availability, len(names))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	// set the API client up before the workers share it
+	getApiClient()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = checkDomainAvailability(names[i])
+			}
+		}()
+	}
+	for i := range names {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return results
+}
+
+// checkDomainAvailability checks whether a name is available and fetches its prices
+// prices are fetched whether or not it's available, as renewal and transfer prices are still of interest
+// It takes one parameter, the name
+// It returns the result
+func checkDomainAvailability(name string) availability {
+	a := availability{Domain: name}
+	r, err := checkDomainStatus(name)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	a.Available = r.Data.Available
+	a.Premium = r.Data.Premium
+	p, err := getDomainPrice(name)
+	if err != nil {
+		// not every TLD can be priced, which isn't a failure of the check itself
+		_verbose(fmt.Sprintf("no prices for %s: %s", name, err))
+		return a
+	}
+	a.RegistrationPrice = &p.Data.RegistrationPrice
+	a.RenewalPrice = &p.Data.RenewalPrice
+	a.TransferPrice = &p.Data.TransferPrice
+	return a
+}
+
+// reportDomainAvailability outputs the results of a bulk check as a table, or as JSON or CSV
+// It takes one parameter, the results
+// It returns the number of names that couldn't be checked
+func reportDomainAvailability(results []availability) int {
+	var failed int
+	for _, a := range results {
+		if a.Error != "" {
+			failed++
+		}
+	}
+	price := func(d *decimal.Decimal) string {
+		if d == nil {
+			return "-"
+		}
+		return formatMoney(*d)
+	}
+
+	switch *outputFormat {
+	case "json":
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error encoding results: %s\n", err)
+			return len(results)
+		}
+		fmt.Fprintln(reportOutput, string(b))
+	case "csv":
+		w := csv.NewWriter(reportOutput)
+		w.Write([]string{"domain", "available", "premium", "registration_price", "renewal_price", "transfer_price", "currency", "error"})
+		for _, a := range results {
+			amount := func(d *decimal.Decimal) string {
+				if d == nil {
+					return ""
+				}
+				return d.StringFixed(2)
+			}
+			w.Write([]string{a.Domain, strconv.FormatBool(a.Available), strconv.FormatBool(a.Premium), amount(a.RegistrationPrice), amount(a.RenewalPrice), amount(a.TransferPrice), config.currency, a.Error})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error writing results: %s\n", err)
+			return len(results)
+		}
+	default:
+		strwidth := len("Domain")
+		for _, a := range results {
+			if len(a.Domain) > strwidth {
+				strwidth = len(a.Domain)
+			}
+		}
+		fmt.Printf("%-*s  %-9s  %-7s  %12s  %12s  %12s\n", strwidth, "Domain", "Available", "Premium", "Registration", "Renewal", "Transfer")
+		for _, a := range results {
+			if a.Error != "" {
+				fmt.Printf("%-*s  ERROR: %s\n", strwidth, a.Domain, a.Error)
+				continue
+			}
+			fmt.Printf("%-*s  %-9v  %-7v  %12s  %12s  %12s\n", strwidth, a.Domain, a.Available, a.Premium, price(a.RegistrationPrice), price(a.RenewalPrice), price(a.TransferPrice))
+		}
+	}
+	return failed
+}
+
+// changeRegistrant changes the registrant of a domain, once the requirements of the change have been
+// shown to the user, any extended attributes collected, and the user has confirmed, and then waits for
+// the change to complete
+// It takes four parameters, the domain, the new registrant contact ID, an optional file of extended
+// attributes, and how long to wait
+// It returns whether the change completed successfully and an error object
+func changeRegistrant(domain string, contact int, suppliedAttributes map[string]string, timeout time.Duration) (bool, error) {
+	d, err := getDomainDetails(domain)
+	if err != nil {
+		return false, err
+	}
+	if d.RegistrantID == int64(contact) {
+		fmt.Printf("Contact %d is already the registrant of %s\n", contact, domain)
+		return true, nil
+	}
+	current, err := getContactDetails(d.RegistrantID)
+	if err != nil {
+		return false, err
+	}
+	c, err := getContactDetails(int64(contact))
+	if err != nil {
+		return false, err
+	}
+
+	client := getApiClient()
+	ctx := context.Background()
+	check, err := client.Registrar.CheckRegistrantChange(ctx, config.accountNumber, &dnsimple.CheckRegistrantChangeInput{
+		DomainId:  strconv.FormatInt(d.ID, 10),
+		ContactId: strconv.Itoa(contact),
+	})
+	if err != nil {
+		return false, fmt.Errorf("error checking registrant change for %s: %s", domain, err)
+	}
+
+	// the check returns attributes in the same shape as the TLD's, so they can be collected the same way
+	var attrs []dnsimple.TldExtendedAttribute
+	for _, a := range check.Data.ExtendedAttributes {
+		attr := dnsimple.TldExtendedAttribute{Name: a.Name, Description: a.Description, Required: a.Required}
+		for _, o := range a.Options {
+			attr.Options = append(attr.Options, dnsimple.TldExtendedAttributeOption{Title: o.Title, Value: o.Value, Description: o.Description})
+		}
+		attrs = append(attrs, attr)
+	}
+	var attributes map[string]string
+	if len(attrs) > 0 {
+		attributes, err = promptForExtendedAttributes(attrs, "this registrant change", suppliedAttributes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("Registrant change summary for %s:\n", domain)
+	fmt.Printf("\tDomain.......: %s\n", domain)
+	fmt.Printf("\tFrom.........: %d : %s %s <%s>\n", current.ID, current.FirstName, current.LastName, current.Email)
+	fmt.Printf("\tTo...........: %d : %s %s <%s>\n", c.ID, c.FirstName, c.LastName, c.Email)
+	for name, value := range attributes {
+		fmt.Printf("\tAttribute....: %s = %s\n", name, value)
+	}
+	// the API doesn't report a fee for the change, so we can't show one
+	fmt.Printf("\tFee..........: not reported by the API; check the registry's terms\n")
+	if check.Data.RegistryOwnerChange {
+		fmt.Printf("\tTransfer Lock: this is a change of owner at the registry, and will lock the domain against transfer for 60 days\n")
+	} else {
+		fmt.Printf("\tTransfer Lock: not triggered\n")
+	}
+	fmt.Println()
+	if !askUserYesNo(fmt.Sprintf("Do you wish to change the registrant of %s to %s %s", domain, c.FirstName, c.LastName)) {
+		fmt.Println("Registrant change aborted")
+		return false, nil
+	}
+
+	r, err := client.Registrar.CreateRegistrantChange(ctx, config.accountNumber, &dnsimple.CreateRegistrantChangeInput{
+		DomainId:           strconv.FormatInt(d.ID, 10),
+		ContactId:          strconv.Itoa(contact),
+		ExtendedAttributes: attributes,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error changing registrant of %s: %s", domain, err)
+	}
+	change := r.Data
+	fmt.Printf("Registrant change %d of %s started. %s\n", change.Id, domain, change.State)
+
+	return waitForRegistrantChange(domain, change.Id, change.State, timeout)
+}
+
+// provisionSpec describes a domain to be provisioned
+type provisionSpec struct {
+	Domain             string            `json:"domain"`
+	Contact            int               `json:"contact,omitempty"`
+	Period             int               `json:"period,omitempty"`
+	WhoisPrivacy       *bool             `json:"whois_privacy,omitempty"`
+	AutoRenew          *bool             `json:"auto_renew,omitempty"`
+	ExtendedAttributes map[string]string `json:"extended_attributes,omitempty"`
+	Nameservers        []string          `json:"nameservers,omitempty"`
+}
+
+// provisionState records how far provisioning of a domain has got, so that it can be resumed
+type provisionState struct {
+	Domain         string    `json:"domain"`
+	Completed      []string  `json:"completed"`
+	RegistrationID int64     `json:"registration_id,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// provisionSteps are the steps of provisioning, in the order they're run
+var provisionSteps = []string{"check", "register", "wait", "nameservers", "ds"}
+
+// done reports whether a step has been completed
+func (state *provisionState) done(step string) bool {
+	for _, s := range state.Completed {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// loadProvisionState reads the provisioning state from a file
+// It returns nil, without an error, if the file does not exist
+func loadProvisionState(file string) (*provisionState, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", file, err)
+	}
+	var state provisionState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", file, err)
+	}
+	return &state, nil
+}
+
+// saveProvisionState writes the provisioning state to a file
+func saveProvisionState(file string, state *provisionState) error {
+	state.UpdatedAt = time.Now().UTC()
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding provisioning state: %s", err)
+	}
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		return fmt.Errorf("error writing %s: %s", file, err)
+	}
+	_debug(fmt.Sprintf("provisioning state saved to %s with %s done", file, strings.Join(state.Completed, ", ")))
+	return nil
+}
+
+// provisionDomain runs the steps to bring a new domain into service, as described by a spec file:
+// 1. check the domain is available (or already registered in the account)
+// 2. register it
+// 3. wait for the registration to complete
+// 4. set the delegation to the nameservers in the spec
+// 5. if the zone is signed, add DS records for its published KSKs
+// Each step is recorded in the state file as it completes, so that after a failure, running it again
+// picks up where it left off
+// It takes three parameters, the spec file, the state file (defaulted from the domain if empty) and
+// how long to wait for the registration
+// It returns an error object
+func provisionDomain(specFile string, stateFile string, timeout time.Duration) error {
+	b, err := os.ReadFile(specFile)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", specFile, err)
+	}
+	var spec provisionSpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return fmt.Errorf("error parsing %s: %s", specFile, err)
+	}
+	spec.Domain = strings.ToLower(strings.TrimSuffix(spec.Domain, "."))
+	if spec.Domain == "" {
+		return fmt.Errorf("%s does not name a domain", specFile)
+	}
+	if spec.Period == 0 {
+		spec.Period = 1
+	}
+
+	if stateFile == "" {
+		stateFile = fmt.Sprintf("dnsimple-provision-%s.json", spec.Domain)
+	}
+	state, err := loadProvisionState(stateFile)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &provisionState{Domain: spec.Domain}
+		fmt.Printf("Provisioning %s; state will be saved in %s\n", spec.Domain, stateFile)
+	} else if state.Domain != spec.Domain {
+		return fmt.Errorf("%s holds provisioning state for %s, not %s", stateFile, state.Domain, spec.Domain)
+	} else {
+		fmt.Printf("Resuming provisioning of %s from %s\n", spec.Domain, stateFile)
+	}
+
+	for i, step := range provisionSteps {
+		fmt.Printf("Step %d of %d, %s: ", i+1, len(provisionSteps), step)
+		if state.done(step) {
+			fmt.Println("already done")
+			continue
+		}
+		fmt.Println("running")
+		var err error
+		switch step {
+		case "check":
+			err = provisionCheck(spec, state)
+		case "register":
+			err = provisionRegister(spec, state, stateFile)
+		case "wait":
+			err = provisionWait(spec, state, timeout)
+		case "nameservers":
+			err = provisionNameservers(spec)
+		case "ds":
+			err = provisionDs(spec)
+		}
+		if err != nil {
+			// save what we've learned (a failed registration clears its ID) before giving up
+			if saveErr := saveProvisionState(stateFile, state); saveErr != nil {
+				return fmt.Errorf("step %s failed: %s; and the state could not be saved, so note it before running provision again: %s (registration ID %d)", step, err, saveErr, state.RegistrationID)
+			}
+			return fmt.Errorf("step %s failed: %s; fix the problem and run provision again to resume", step, err)
+		}
+		if !state.done(step) {
+			state.Completed = append(state.Completed, step)
+		}
+		if err := saveProvisionState(stateFile, state); err != nil {
+			return err
+		}
+		fmt.Printf("  => %s done\n", step)
+	}
+	fmt.Printf("Provisioning of %s is complete\n", spec.Domain)
+	return nil
+}
+
+// provisionCheck checks the domain is available to register; if it's already registered in the
+// account, perhaps by an earlier run whose state was lost, the registration steps are marked as done
+func provisionCheck(spec provisionSpec, state *provisionState) error {
+	if d, err := getDomainDetails(spec.Domain); err == nil && d.State == "registered" {
+		fmt.Printf("  => %s is already registered in the account\n", spec.Domain)
+		state.Completed = append(state.Completed, "register", "wait")
+		return nil
+	}
+	r, err := checkDomainStatus(spec.Domain)
+	if err != nil {
+		return err
+	}
+	if !r.Data.Available {
+		return fmt.Errorf("%s is NOT available to register", spec.Domain)
+	}
+	fmt.Printf("  => %s is available\n", spec.Domain)
+	return nil
+}
+
+// provisionRegister registers the domain, saving the registration ID before it's waited on
+func provisionRegister(spec provisionSpec, state *provisionState, stateFile string) error {
+	// a registration already submitted, whose step wasn't marked done, is left to the wait step
+	if state.RegistrationID != 0 {
+		fmt.Printf("  => registration %d has already been submitted\n", state.RegistrationID)
+		return nil
+	}
+	var query string
+	if spec.Contact != 0 {
+		query = strconv.Itoa(spec.Contact)
+	}
+	contact, err := resolveRegistrant(query)
+	if err != nil {
+		return err
+	}
+	whoisPrivacy := config.whoisPrivacy
+	if spec.WhoisPrivacy != nil {
+		whoisPrivacy = *spec.WhoisPrivacy
+	}
+	autoRenew := config.autoRenew
+	if spec.AutoRenew != nil {
+		autoRenew = *spec.AutoRenew
+	}
+	registration, err := registerDomainWithChecks(spec.Domain, contact, spec.Period, whoisPrivacy, autoRenew, spec.ExtendedAttributes)
+	if err != nil {
+		return err
+	}
+	if registration == nil {
+		return fmt.Errorf("registration aborted")
+	}
+	state.RegistrationID = registration.ID
+	return saveProvisionState(stateFile, state)
+}
+
+// provisionWait waits for the registration to complete; if it failed, the registration step is
+// cleared so that it's tried again on the next run
+func provisionWait(spec provisionSpec, state *provisionState, timeout time.Duration) error {
+	if state.RegistrationID == 0 {
+		return fmt.Errorf("no registration ID has been recorded")
+	}
+	client := getApiClient()
+	r, err := client.Registrar.GetDomainRegistration(context.Background(), config.accountNumber, spec.Domain, strconv.FormatInt(state.RegistrationID, 10))
+	if err != nil {
+		return fmt.Errorf("error fetching registration %d of %s: %s", state.RegistrationID, spec.Domain, err)
+	}
+	// a wait of zero would skip the step, which would leave nothing else checking the registration
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ok, err := waitForRegistration(spec.Domain, state.RegistrationID, r.Data.State, timeout)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		var completed []string
+		for _, s := range state.Completed {
+			if s != "register" {
+				completed = append(completed, s)
+			}
+		}
+		state.Completed = completed
+		state.RegistrationID = 0
+		return fmt.Errorf("registration of %s did not succeed", spec.Domain)
+	}
+	return nil
+}
+
+// provisionNameservers sets the delegation to the nameservers in the spec, if any, after the same
+// preflight checks as dnsimple-ns
+func provisionNameservers(spec provisionSpec) error {
+	if len(spec.Nameservers) == 0 {
+		fmt.Println("  => no nameservers in the spec; leaving the delegation alone")
+		return nil
+	}
+	nsRecords, err := getNsFromRegistry(spec.Domain)
+	if err != nil {
+		return err
+	}
+	current := normaliseNameservers(*nsRecords.Data)
+	proposed := normaliseNameservers(spec.Nameservers)
+	if strings.Join(proposed, " ") == strings.Join(current, " ") {
+		fmt.Printf("  => the delegation is already %s\n", strings.Join(current, " "))
+		return nil
+	}
+
+	findings := checkProposedNameservers(spec.Domain, proposed)
+	warnings, errs := reportPreflightFindings(findings, "delegation")
+	if proceed, err := preflightAllows(warnings, errs, true); err != nil {
+		return fmt.Errorf("the proposed nameservers: %s", err)
+	} else if !proceed {
+		return fmt.Errorf("delegation change aborted")
+	}
+
+	var submit []string
+	for _, ns := range proposed {
+		submit = append(submit, strings.TrimSuffix(ns, "."))
+	}
+	if _, err := changeNsInRegistry(spec.Domain, submit); err != nil {
+		return err
+	}
+	fmt.Printf("  => delegation set to %s\n", strings.Join(proposed, " "))
+	return nil
+}
+
+// provisionDs adds DS records for the zone's published KSKs, if it's signed, after the same preflight
+// checks as dnsimple-ds
+func provisionDs(spec provisionSpec) error {
+	keys, err := getDnskeyFromDns(spec.Domain)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve DNSKEYs for %s: %s", spec.Domain, err)
+	}
+	var ksks []dns.DNSKEY
+	for _, key := range keys {
+		if key.Flags&dns.SEP != 0 && key.Flags&dns.REVOKE == 0 {
+			ksks = append(ksks, key)
+		}
+	}
+	if len(ksks) == 0 {
+		fmt.Printf("  => %s isn't signed; no DS records needed\n", spec.Domain)
+		return nil
+	}
+
+	interfaceType, err := getTldDnssecInterfaceType(spec.Domain)
+	if err != nil {
+		return fmt.Errorf("cannot determine whether the registry takes DS or DNSKEY data: %s", err)
+	}
+	for _, key := range ksks {
+		keytag := key.KeyTag()
+		// an error with ok set means the DS isn't there; without it, the registry couldn't be asked
+		if _, ok, _, err := dsExistsInRegistry(spec.Domain, keytag); !ok {
+			return err
+		} else if err == nil {
+			fmt.Printf("  => DS for keytag %d is already in the registry\n", keytag)
+			continue
+		}
+		findings, err := getPreflightFindings(spec.Domain, key)
+		if err != nil {
+			return err
+		}
+		warnings, errs := reportPreflightFindings(findings, "addition")
+		if proceed, err := preflightAllows(warnings, errs, true); err != nil {
+			return fmt.Errorf("the DS for keytag %d: %s", keytag, err)
+		} else if !proceed {
+			return fmt.Errorf("DS addition aborted")
+		}
+		r, err := addDelegationSignerRecordToRegistry(spec.Domain, makeDelegationSignerRecordFromDnskey(key, interfaceType))
+		if err != nil {
+			return fmt.Errorf("error creating DS record for keytag %d: %s", keytag, err)
+		}
+		fmt.Printf("  => DS record with keytag %d created in the registry with ID %d\n", keytag, r.Data.ID)
+	}
+	return nil
+}
+
+// decommissionState records how far decommissioning of a domain has got, so that it can be resumed
+type decommissionState struct {
+	Domain    string    `json:"domain"`
+	Phase     int       `json:"phase"`
+	Parking   []string  `json:"parking,omitempty"`
+	Delete    bool      `json:"delete"`
+	DsTTL     uint32    `json:"ds_ttl,omitempty"`
+	DsGoneAt  time.Time `json:"ds_gone_at"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// loadDecommissionState reads the decommissioning state from a file
+// It returns nil, without an error, if the file does not exist
+func loadDecommissionState(file string) (*decommissionState, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", file, err)
+	}
+	var state decommissionState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", file, err)
+	}
+	return &state, nil
+}
+
+// saveDecommissionState writes the decommissioning state to a file
+func saveDecommissionState(file string, state *decommissionState) error {
+	state.UpdatedAt = time.Now().UTC()
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding decommissioning state: %s", err)
+	}
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		return fmt.Errorf("error writing %s: %s", file, err)
+	}
+	_debug(fmt.Sprintf("decommissioning state saved to %s at phase %d", file, state.Phase))
+	return nil
+}
+
+// decommissionDomain retires a domain in phases, saving state between runs:
+// 1. remove the DS records, so that validators stop expecting the zone to be signed
+// 2. wait for the DS to go from the parent and its TTL to pass
+// 3. optionally re-delegate to parking nameservers
+// 4. disable auto renewal
+// 5. optionally delete the domain from the account
+// Doing these out of order, e.g. re-delegating while a DS is still published, leaves the domain failing
+// validation until it expires
+// It takes four parameters, the domain, the parking nameservers and whether to delete the domain (both only
+// used on the first run) and the state file
+// It returns a bool indicating whether decommissioning is complete, rather than stopped to be re-run, and
+// an error object
+func decommissionDomain(domain string, parking []string, deleteDomain bool, stateFile string) (bool, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	state, err := loadDecommissionState(stateFile)
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		state = &decommissionState{Domain: domain, Parking: normaliseNameservers(parking), Delete: deleteDomain, StartedAt: time.Now().UTC()}
+		fmt.Printf("Starting decommissioning of %s; state will be saved in %s\n", domain, stateFile)
+	} else if state.Domain != domain {
+		return false, fmt.Errorf("%s holds decommissioning state for %s, not %s", stateFile, state.Domain, domain)
+	} else {
+		fmt.Printf("Resuming decommissioning of %s from %s at phase %d\n", domain, stateFile, state.Phase+1)
+	}
+
+	for state.Phase < 5 {
+		var done bool
+		switch state.Phase + 1 {
+		case 1:
+			fmt.Printf("\n== Phase 1: removing the DS records\n")
+			done, err = decommissionRemoveDs(state)
+		case 2:
+			fmt.Printf("\n== Phase 2: waiting out the DS TTL\n")
+			done, err = decommissionWaitForDs(state)
+		case 3:
+			fmt.Printf("\n== Phase 3: re-delegating to the parking nameservers\n")
+			done, err = decommissionPark(state)
+		case 4:
+			fmt.Printf("\n== Phase 4: disabling auto renewal\n")
+			done, err = decommissionDisableAutoRenew(state)
+		case 5:
+			fmt.Printf("\n== Phase 5: deleting the domain from the account\n")
+			done, err = decommissionDelete(state)
+		}
+		if err != nil {
+			if saveErr := saveDecommissionState(stateFile, state); saveErr != nil {
+				return false, fmt.Errorf("%s; and %s", err, saveErr)
+			}
+			return false, err
+		}
+		if !done {
+			return false, saveDecommissionState(stateFile, state)
+		}
+		state.Phase++
+		if err := saveDecommissionState(stateFile, state); err != nil {
+			return false, err
+		}
+	}
+
+	fmt.Printf("\nDecommissioning of %s is complete\n", domain)
+	return true, nil
+}
+
+// decommissionRemoveDs is phase 1 of decommissionDomain
+// The TTL of the DS at the parent is noted before anything is removed, for phase 2
+// It returns a bool indicating whether the phase is complete, and an error object
+func decommissionRemoveDs(state *decommissionState) (bool, error) {
+	dsRecords, err := getDsFromRegistry(state.Domain)
+	if err != nil {
+		return false, err
+	}
+
+	// the parent is always checked, as it may still publish a DS that's already gone from the registry,
+	// e.g. one just removed by hand, and validators will expect signatures until it has gone
+	parentDs, server, err := getDsFromParent(state.Domain)
+	if err != nil {
+		return false, err
+	}
+	for _, ds := range parentDs {
+		if ds.Hdr.Ttl > state.DsTTL {
+			state.DsTTL = ds.Hdr.Ttl
+		}
+	}
+	if len(dsRecords.Data) == 0 {
+		fmt.Println("There are no DS records in the registry")
+		if len(parentDs) > 0 {
+			fmt.Printf("%s still publishes %d DS record(s) for %s, with a TTL of %ds\n", server, len(parentDs), state.Domain, state.DsTTL)
+		}
+		return true, nil
+	}
+	if state.DsTTL == 0 {
+		// the parent isn't publishing them yet, so assume a day, which is the most common TTL
+		state.DsTTL = 86400
+	}
+
+	fmt.Printf("DS records in the registry for %s:\n", state.Domain)
+	for _, dsr := range dsRecords.Data {
+		fmt.Printf("  => %s %s %s %s\n", dsr.Keytag, dsr.Algorithm, dsr.DigestType, dsr.Digest)
+	}
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to delete these %d DS record(s)?", len(dsRecords.Data))) {
+		fmt.Println("Operation aborted")
+		return false, nil
+	}
+	client := getApiClient()
+	for _, dsr := range dsRecords.Data {
+		_, err := client.Domains.DeleteDelegationSignerRecord(context.Background(), config.accountNumber, state.Domain, dsr.ID)
+		if err != nil {
+			return false, fmt.Errorf("error deleting DS record with keytag %s: %s", dsr.Keytag, err)
+		}
+		fmt.Printf("DS record with keytag %s deleted from the registry\n", dsr.Keytag)
+	}
+	return true, nil
+}
+
+// decommissionWaitForDs is phase 2 of decommissionDomain
+// The wait starts once the parent stops publishing the DS, and lasts for the DS TTL noted in phase 1
+// It returns a bool indicating whether the phase is complete, and an error object
+func decommissionWaitForDs(state *decommissionState) (bool, error) {
+	if state.DsTTL == 0 {
+		fmt.Println("Neither the registry nor the parent had DS records; nothing to wait for")
+		return true, nil
+	}
+	if state.DsGoneAt.IsZero() {
+		parentDs, server, err := getDsFromParent(state.Domain)
+		if err != nil {
+			return false, err
+		}
+		if len(parentDs) > 0 {
+			fmt.Printf("%s still publishes %d DS record(s) for %s; re-run later\n", server, len(parentDs), state.Domain)
+			return false, nil
+		}
+		state.DsGoneAt = time.Now().UTC()
+		fmt.Printf("The parent no longer publishes DS records for %s\n", state.Domain)
+	}
+	ready := state.DsGoneAt.Add(time.Duration(state.DsTTL) * time.Second)
+	if time.Now().Before(ready) {
+		fmt.Printf("The DS TTL is %ds; re-run after %s (%s from now)\n", state.DsTTL, ready.Format(time.RFC3339), time.Until(ready).Round(time.Second))
+		return false, nil
+	}
+	fmt.Printf("The DS TTL of %ds has passed\n", state.DsTTL)
+	return true, nil
+}
+
+// decommissionPark is phase 3 of decommissionDomain, which is skipped if no parking nameservers were given
+// It returns a bool indicating whether the phase is complete, and an error object
+func decommissionPark(state *decommissionState) (bool, error) {
+	if len(state.Parking) == 0 {
+		fmt.Println("No parking nameservers were given; leaving the delegation alone")
+		return true, nil
+	}
+	nsRecords, err := getNsFromRegistry(state.Domain)
+	if err != nil {
+		return false, err
+	}
+	current := normaliseNameservers(*nsRecords.Data)
+	if strings.Join(current, " ") == strings.Join(state.Parking, " ") {
+		fmt.Printf("The delegation is already %s\n", strings.Join(current, " "))
+		return true, nil
+	}
+	fmt.Printf("Current NS records.: %s\n", strings.Join(current, " "))
+	fmt.Printf("Proposed NS records: %s\n", strings.Join(state.Parking, " "))
+
+	findings := checkProposedNameservers(state.Domain, state.Parking)
+	warnings, errs := reportPreflightFindings(findings, "change")
+	proceed, err := preflightAllows(warnings, errs, true)
+	if err != nil {
+		return false, err
+	}
+	if !proceed || (warnings+errs == 0 && !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to change the delegation for %s?", state.Domain))) {
+		fmt.Println("Operation aborted")
+		return false, nil
+	}
+
+	var submit []string
+	for _, ns := range state.Parking {
+		submit = append(submit, strings.TrimSuffix(ns, "."))
+	}
+	if _, err := changeNsInRegistry(state.Domain, submit); err != nil {
+		return false, err
+	}
+	fmt.Printf("Delegation changed to %s\n", strings.Join(state.Parking, " "))
+	return true, nil
+}
+
+// decommissionDisableAutoRenew is phase 4 of decommissionDomain
+// It returns a bool indicating whether the phase is complete, and an error object
+func decommissionDisableAutoRenew(state *decommissionState) (bool, error) {
+	settings, err := getDomainSettings(state.Domain)
+	if err != nil {
+		return false, err
+	}
+	if !settings.AutoRenew {
+		fmt.Println("Auto renewal is already disabled")
+		return true, nil
+	}
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to disable auto renewal of %s?", state.Domain)) {
+		fmt.Println("Operation aborted")
+		return false, nil
+	}
+	if err := setDomainSetting(state.Domain, "autorenew", false); err != nil {
+		return false, err
+	}
+	fmt.Printf("Auto renewal of %s disabled\n", state.Domain)
+	return true, nil
+}
+
+// decommissionDelete is phase 5 of decommissionDomain, which is skipped unless -delete was given
+// This always asks for confirmation, even with -force, as it can't be undone
+// It returns a bool indicating whether the phase is complete, and an error object
+func decommissionDelete(state *decommissionState) (bool, error) {
+	if !state.Delete {
+		fmt.Println("Deletion wasn't requested; the domain stays in the account until it expires")
+		return true, nil
+	}
+	if !askUserYesNo(fmt.Sprintf("Do you want to delete %s from the account? This can't be undone", state.Domain)) {
+		fmt.Println("Operation aborted")
+		return false, nil
+	}
+	client := getApiClient()
+	_, err := client.Domains.DeleteDomain(context.Background(), config.accountNumber, state.Domain)
+	if err != nil {
+		return false, fmt.Errorf("error deleting %s from the account: %s", state.Domain, err)
+	}
+	fmt.Printf("%s deleted from the account\n", state.Domain)
+	return true, nil
+}
@@ -12,11 +12,18 @@ TODO (no particular order):
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dnsimple/dnsimple-go/dnsimple"
 	"github.com/miekg/dns"
@@ -30,12 +37,23 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\tlist, listds:\tlist the DS records in the registry\n\tlistkeys:\tlist the DNSKEY records in DNS\n\tlistall:\tlist everything\n")
 		fmt.Fprintf(os.Stderr, "\tadd:\t\tadd the supplied keytag, or, if no keytag is supplied, lists the DNSKEY records in DNS\n")
 		fmt.Fprintf(os.Stderr, "\tdelete:\t\tdelete the supplied keytag, or, if no keytag is supplied, lists the DS records in the registry\n")
+		fmt.Fprintf(os.Stderr, "\tprune:\t\tdelete all DS records in the registry that do not match a DNSKEY record in DNS\n")
+		fmt.Fprintf(os.Stderr, "\texport:\t\texport the DS records in the registry to -file (or stdout) in the -format given\n")
+		fmt.Fprintf(os.Stderr, "\timport:\t\tmake the DS records in the registry match those in -file in the -format given\n")
+		fmt.Fprintf(os.Stderr, "\tverify:\t\tverify the chain of trust between the registry, the parent zone and the DNSKEY records in DNS\n")
 		fmt.Fprintf(os.Stderr, "\n")
 		flag.PrintDefaults()
 	}
 
+	var format string
+	flag.StringVar(&format, "format", "zone", "export/import format; zone, json or csv")
+
+	var file string
+	flag.StringVar(&file, "file", "", "file to export to or import from")
+
 	// parse the CLI flags
 	flag.Parse()
+	setupOutput()
 
 	// set verbosity if debug is enabled
 	if *debugOutput && !*verboseOutput {
@@ -152,94 +170,30 @@ func main() {
 			if err == nil {
 				_verbose(fmt.Sprintf("DNSKEY with keytag %d exists in DNS in %s", keytag, domain))
 
-				// validate that the keyset is signed with the DNSKEY requested
-				// if it is NOT signed with this key, but is the same algorithm as the existing DS record(s), adding will NOT cause issues
-				keyset, err := doQuery(domain, dns.TypeDNSKEY)
+				// run the preflight checks against the requested key
+				findings, err := getPreflightFindings(domain, dnskeyRr)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: cannot retrieve keyset for domain %s: %s\n", domain, err)
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 					os.Exit(1)
 				}
-
-				var keysetSignedWithRequestedKey bool = false
-				keyAlgs := make(map[uint8]uint8)
-				for _, ans := range keyset.Answer {
-					switch rr := ans.(type) {
-					case *dns.RRSIG:
-						_debug(fmt.Sprintf("got RRSIG with keytag %d and algorithm %d", rr.KeyTag, rr.Algorithm))
-						keyAlgs[rr.Algorithm]++
-						if keytag == rr.KeyTag {
-							keysetSignedWithRequestedKey = true
-						}
-					}
-				}
-				var warnings []string
-				if keysetSignedWithRequestedKey {
-					_verbose(fmt.Sprintf("The DNSKEY keyset in domain %s is signed with keytag %d", domain, keytag))
-				} else {
-					_debug(fmt.Sprintf("Warning: the DNSKEY keyset in domain %s is NOT signed with keytag %d", domain, keytag))
-					warnings = append(warnings, fmt.Sprintf("The DNSKEY record set is not signed with the DNSKEY with keytag %d", keytag))
-					existingDsSet, err := getDsFromRegistry(domain)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "Error: failed to fetch existing DS records from registry for domain %s: %s\n", domain, err)
-						os.Exit(1)
-					}
-					for _, ds := range existingDsSet.Data {
-						dsA, err := strconv.ParseUint(ds.Algorithm, 10, 8)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "Error: error converting string to integer: %s\n", err)
-							os.Exit(1)
-						}
-						dsAlg := uint8(dsA)
-						if keyAlgs[dsAlg] > 0 {
-							_debug(fmt.Sprintf("Requested addition (%d) matches algorithm of existing DS record(s) (%d)", dnskeyRr.Algorithm, keyAlgs))
-							if len(warnings) > 0 {
-								warnings[0] = fmt.Sprintf("%s\n     (although it's of the same algorithm as existing DS records, so may be ok if you're pre-publishing)", warnings[0])
-							}
-						} else {
-							_debug(fmt.Sprintf("Warning: algorithm of requested DS addition (%d) does NOT match the algorithm of an existing DS record(s) (%d)", dnskeyRr.Algorithm, keyAlgs))
-							warnings = append(warnings, fmt.Sprintf("The DNSKEY with keytag %d does NOT match algorithm of existing DS record(s)", keytag))
-						}
-					}
-				}
-
-				// add a warning if it's a ZSK
-				if dnskeyRr.Flags == 256 {
-					_debug(fmt.Sprintf("Warning: the DNSKEY with keytag %d is a ZSK (%d)", keytag, dnskeyRr.Flags))
-					warnings = append(warnings, fmt.Sprintf("The DNSKEY with keytag %d is a ZSK", keytag))
+				warnings, errs := reportPreflightFindings(findings, "addition")
+				proceed, err := preflightAllows(warnings, errs, true)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+					os.Exit(1)
 				}
-
-				switch len(warnings) {
-				case 0:
-					_debug("There are no warnings")
-				case 1:
-					fmt.Printf("There is a warning for this addition:\n")
-					fmt.Printf("  => %s\n", warnings[0])
-				default:
-					fmt.Printf("There are %d warnings for this addition:\n", len(warnings))
-					for _, w := range warnings {
-						fmt.Printf("  => %s\n", w)
-					}
+				if !proceed {
+					fmt.Println("Operation aborted")
+					return
 				}
 
-				if len(warnings) > 0 {
-					if *forceOperation {
-						_debug("there are warnings, but the -force flag overrides")
-					} else if !askUserYesNo("Given the warnings, do you want to proceed?") {
-						fmt.Println("Operation aborted")
-						return
-					}
+				// we've done all the checks, create and add the DS (or the key data, if that's what the registry wants)
+				interfaceType, err := getTldDnssecInterfaceType(domain)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: cannot determine whether the registry takes DS or DNSKEY data: %s\n", err)
+					os.Exit(1)
 				}
-
-				// we've done all the checks, create and add the DS
-				_verbose(fmt.Sprintf("Creating DS record witih digest type %s from DNSKEY record", dns.HashToString[config.dsDigestType]))
-				dsRr := dnskeyRr.ToDS(config.dsDigestType)
-				_debug(fmt.Sprintf("DS record created: DS %d %d %d %s", dsRr.KeyTag, dsRr.Algorithm, dsRr.DigestType, dsRr.Digest))
-
-				var delegationSigner dnsimple.DelegationSignerRecord
-				delegationSigner.Keytag = strconv.FormatUint(uint64(dsRr.KeyTag), 10)
-				delegationSigner.Algorithm = strconv.FormatUint(uint64(dsRr.Algorithm), 10)
-				delegationSigner.DigestType = strconv.FormatUint(uint64(dsRr.DigestType), 10)
-				delegationSigner.Digest = dsRr.Digest
+				delegationSigner := makeDelegationSignerRecordFromDnskey(dnskeyRr, interfaceType)
 				client := getApiClient()
 				dsResponse, err := client.Domains.CreateDelegationSignerRecord(context.Background(), config.accountNumber, domain, delegationSigner)
 				if err != nil {
@@ -287,9 +241,588 @@ func main() {
 				os.Exit(1)
 			}
 		}
+	case "prune":
+		fmt.Printf("Pruning stale DS records in the registry for domain %s\n", domain)
+		err := pruneStaleDs(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error pruning DS records for domain %s: %s\n", domain, err)
+			os.Exit(1)
+		}
+	case "export":
+		err := exportDsSet(domain, format, file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error exporting DS records for domain %s: %s\n", domain, err)
+			os.Exit(1)
+		}
+	case "import":
+		if file == "" {
+			fmt.Fprintf(os.Stderr, "Error: a file to import from must be supplied with -file\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		fmt.Printf("Importing DS records for domain %s from %s\n", domain, file)
+		err := importDsSet(domain, format, file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error importing DS records for domain %s: %s\n", domain, err)
+			os.Exit(1)
+		}
+	case "verify":
+		fmt.Printf("Verifying the chain of trust for domain %s\n", domain)
+		broken, err := verifyChainOfTrust(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error verifying the chain of trust for domain %s: %s\n", domain, err)
+			os.Exit(1)
+		}
+		if broken {
+			os.Exit(1)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "Error: unknown action: %s\n", action)
 		flag.Usage()
 		os.Exit(1)
 	}
 }
+
+// verifyChainOfTrust cross-checks the DS records in the registry and those being served by the parent
+// zone against the DNSKEY RRset published in the child zone and the RRSIGs covering it
+// It takes one parameter, the domain to be verified
+// It returns a bool indicating whether the chain of trust is broken, and an error object
+// should the checks not be able to be carried out
+func verifyChainOfTrust(domain string) (bool, error) {
+	dsRecords, err := getDsFromRegistry(domain)
+	if err != nil {
+		return false, err
+	}
+	var registrySet []dns.DS
+	var unknown []string
+	for _, dsr := range dsRecords.Data {
+		ds, err := makeDsFromDelegationSignerRecord(domain, dsr)
+		if err != nil {
+			// a record that can't be rebuilt can't be compared, which isn't the same as not matching
+			unknown = append(unknown, fmt.Sprintf("ID %d; keytag: %s; unknown: %s", dsr.ID, dsr.Keytag, err))
+			continue
+		}
+		registrySet = append(registrySet, ds)
+	}
+
+	parentSet, server, err := getDsFromParent(domain)
+	if err != nil {
+		return false, fmt.Errorf("error fetching DS records from the parent zone: %s", err)
+	}
+
+	keys, sigs, err := getDnskeyRrsetFromDns(domain)
+	if err != nil {
+		return false, fmt.Errorf("error fetching DNSKEY records from DNS: %s", err)
+	}
+
+	var problems []string
+
+	// work out which keys have a valid signature over the DNSKEY RRset
+	signingKeys := make(map[uint16]bool)
+	now := time.Now()
+	for _, sig := range sigs {
+		var signer *dns.DNSKEY
+		for _, rr := range keys {
+			k := rr.(*dns.DNSKEY)
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm {
+				signer = k
+			}
+		}
+		switch {
+		case signer == nil:
+			problems = append(problems, fmt.Sprintf("The RRSIG over the DNSKEY RRset with keytag %d has no matching DNSKEY", sig.KeyTag))
+		case !sig.ValidityPeriod(now):
+			problems = append(problems, fmt.Sprintf("The RRSIG over the DNSKEY RRset with keytag %d is outside its validity period (%s to %s)", sig.KeyTag, dns.TimeToString(sig.Inception), dns.TimeToString(sig.Expiration)))
+		default:
+			if err := sig.Verify(signer, keys); err != nil {
+				problems = append(problems, fmt.Sprintf("The RRSIG over the DNSKEY RRset with keytag %d does not verify: %s", sig.KeyTag, err))
+			} else {
+				_debug(fmt.Sprintf("RRSIG over the DNSKEY RRset with keytag %d verifies", sig.KeyTag))
+				signingKeys[sig.KeyTag] = true
+			}
+		}
+	}
+
+	fmt.Printf("DS records in the registry:\n")
+	if len(registrySet)+len(unknown) == 0 {
+		fmt.Printf("  => none\n")
+	}
+	for _, ds := range registrySet {
+		fmt.Printf("  => %s\n", formatDs(ds))
+	}
+	for _, u := range unknown {
+		fmt.Printf("  => %s\n", u)
+	}
+	fmt.Printf("DS records served by the parent zone (from %s):\n", server)
+	if len(parentSet) == 0 {
+		fmt.Printf("  => none\n")
+	}
+	for _, ds := range parentSet {
+		fmt.Printf("  => %s\n", formatDs(ds))
+	}
+	fmt.Printf("DNSKEY records in DNS:\n")
+	if len(keys) == 0 {
+		fmt.Printf("  => none\n")
+	}
+	for _, rr := range keys {
+		k := rr.(*dns.DNSKEY)
+		keyType := "ZSK"
+		if k.Flags&dns.SEP == dns.SEP {
+			keyType = "KSK"
+		}
+		fmt.Printf("  => DNSKEY; keytag: %5d; flags: %d (%s); Algorithm: %d (%s); signs DNSKEY RRset: %v\n", k.KeyTag(), k.Flags, keyType, k.Algorithm, dns.AlgorithmToString[k.Algorithm], signingKeys[k.KeyTag()])
+	}
+
+	// index the two DS sets so we can spot records in one but not the other
+	inRegistry := make(map[string]bool)
+	for _, ds := range registrySet {
+		inRegistry[dsKey(ds)] = true
+	}
+	inParent := make(map[string]bool)
+	allDs := registrySet
+	for _, ds := range parentSet {
+		inParent[dsKey(ds)] = true
+		if !inRegistry[dsKey(ds)] {
+			allDs = append(allDs, ds)
+		}
+	}
+
+	var secure bool
+	for _, ds := range allDs {
+		var matched, digestOk bool
+		for _, rr := range keys {
+			m, d := dsMatchesDnskey(ds, rr.(*dns.DNSKEY))
+			if m {
+				matched = true
+			}
+			if d {
+				digestOk = true
+			}
+		}
+		switch {
+		case !matched:
+			problems = append(problems, fmt.Sprintf("%s is orphaned; there is no matching DNSKEY", formatDs(ds)))
+		case !digestOk:
+			problems = append(problems, fmt.Sprintf("%s has a digest that does not match DNSKEY with keytag %d", formatDs(ds), ds.KeyTag))
+		}
+		if inRegistry[dsKey(ds)] && !inParent[dsKey(ds)] {
+			problems = append(problems, fmt.Sprintf("%s is in the registry but not yet served by the parent zone", formatDs(ds)))
+		}
+		if inParent[dsKey(ds)] && !inRegistry[dsKey(ds)] {
+			if len(unknown) > 0 {
+				_verbose(fmt.Sprintf("%s is served by the parent zone, and may be one of the registry's records that can't be rebuilt", formatDs(ds)))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s is served by the parent zone but is not in the registry", formatDs(ds)))
+			}
+		}
+		if inParent[dsKey(ds)] && digestOk && signingKeys[ds.KeyTag] {
+			secure = true
+		}
+	}
+
+	// KSKs should have a DS; ZSKs are not expected to
+	for _, rr := range keys {
+		k := rr.(*dns.DNSKEY)
+		if k.Flags&dns.SEP != dns.SEP {
+			continue
+		}
+		var hasDs bool
+		for _, ds := range allDs {
+			if _, d := dsMatchesDnskey(ds, k); d {
+				hasDs = true
+			}
+		}
+		if !hasDs && len(unknown) > 0 {
+			_verbose(fmt.Sprintf("The DNSKEY with keytag %d may have one of the registry's DS records that can't be rebuilt", k.KeyTag()))
+		} else if !hasDs {
+			problems = append(problems, fmt.Sprintf("The DNSKEY with keytag %d is a KSK with no DS record", k.KeyTag()))
+		}
+	}
+
+	fmt.Println()
+	switch len(problems) {
+	case 0:
+		fmt.Printf("There are no problems\n")
+	case 1:
+		fmt.Printf("There is a problem:\n")
+	default:
+		fmt.Printf("There are %d problems:\n", len(problems))
+	}
+	for _, p := range problems {
+		fmt.Printf("  => %s\n", p)
+	}
+
+	switch {
+	case len(parentSet) == 0:
+		fmt.Printf("The parent zone serves no DS records for %s; the domain is insecure\n", domain)
+		return false, nil
+	case secure:
+		fmt.Printf("The chain of trust for %s is intact\n", domain)
+		return false, nil
+	default:
+		fmt.Printf("The chain of trust for %s is BROKEN; no DS record served by the parent zone matches a DNSKEY that signs the DNSKEY RRset\n", domain)
+		return true, nil
+	}
+}
+
+// pruneStaleDs removes every DS record in the registry that does not match a DNSKEY published in DNS
+// A DS record is only considered valid if its digest matches that computed from a published DNSKEY
+// The stale records are listed and the user is asked to confirm before they are all removed
+// It refuses to remove them if doing so would leave no valid DS records, unless -force is used
+// It takes one parameter, the domain to be pruned
+// It returns an error object if the records could not be checked or any of the deletions failed
+func pruneStaleDs(domain string) error {
+	dsRecords, err := getDsFromRegistry(domain)
+	if err != nil {
+		return err
+	}
+	keys, _, err := getDnskeyRrsetFromDns(domain)
+	if err != nil {
+		return fmt.Errorf("error fetching DNSKEY records from DNS: %s", err)
+	}
+
+	var stale []dnsimple.DelegationSignerRecord
+	var valid int
+	for _, dsr := range dsRecords.Data {
+		ds, err := makeDsFromDelegationSignerRecord(domain, dsr)
+		if err != nil {
+			// it can't be said to be stale if it can't be compared, so it's left alone
+			fmt.Printf("DS record with keytag %s (ID %d) cannot be checked, so will be kept: %s\n", dsr.Keytag, dsr.ID, err)
+			continue
+		}
+		var digestOk bool
+		for _, rr := range keys {
+			if _, d := dsMatchesDnskey(ds, rr.(*dns.DNSKEY)); d {
+				digestOk = true
+			}
+		}
+		if digestOk {
+			_verbose(fmt.Sprintf("%s (ID %d) matches a published DNSKEY", formatDs(ds), dsr.ID))
+			valid++
+		} else {
+			stale = append(stale, dsr)
+		}
+	}
+
+	switch len(stale) {
+	case 0:
+		fmt.Printf("There are no stale DS records\n")
+		return nil
+	case 1:
+		fmt.Printf("There is %d stale DS record with no matching DNSKEY:\n", len(stale))
+	default:
+		fmt.Printf("There are %d stale DS records with no matching DNSKEY:\n", len(stale))
+	}
+	for _, dsr := range stale {
+		fmt.Printf("  => DS %5s %s %s %s (ID %d, created %s)\n", dsr.Keytag, dsr.Algorithm, dsr.DigestType, dsr.Digest, dsr.ID, dsr.CreatedAt)
+	}
+
+	if valid == 0 {
+		if *forceOperation {
+			_debug("removing these would leave no valid DS records but the -force flag overrides")
+		} else {
+			return errors.New("removing these would leave no valid DS records and break the chain of trust; use -force to override")
+		}
+	}
+
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to delete these %d DS records, leaving %d?", len(stale), valid)) {
+		fmt.Println("Operation aborted")
+		return nil
+	}
+
+	client := getApiClient()
+	var failed int
+	for _, dsr := range stale {
+		_, err := client.Domains.DeleteDelegationSignerRecord(context.Background(), config.accountNumber, domain, dsr.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error received from registrar API while deleting DS record (keytag %s, ID %d): %s\n", dsr.Keytag, dsr.ID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("DS record with keytag %s and ID %d in domain %s deleted\n", dsr.Keytag, dsr.ID, domain)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deletions failed", failed, len(stale))
+	}
+	return nil
+}
+
+// exportDsSet writes the DS records in the registry out in the requested format
+// The zone format writes DS records as they would appear in the parent's zone file, with the
+// registry ID and creation timestamp in a trailing comment; json and csv carry the same details as fields
+// Registries that take DNSKEY data hold no digest, so their records are written as DNSKEY lines in the
+// zone format, and with the key in the public_key field in csv
+// It takes three parameters, the domain, the format and the file to write to (stdout if empty)
+// It returns an error object
+func exportDsSet(domain string, format string, file string) error {
+	// checked up front, so a mistyped format fails before anything is fetched or written
+	switch format {
+	case "zone", "json", "csv":
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+	dsRecords, err := getDsFromRegistry(domain)
+	if err != nil {
+		return err
+	}
+
+	// files are written alongside and renamed into place, so a failed export leaves an existing file as it was
+	var w io.Writer = reportOutput
+	var f *os.File
+	if file != "" {
+		f, err = os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+		if err != nil {
+			return fmt.Errorf("error creating %s: %s", file, err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "zone":
+		for _, dsr := range dsRecords.Data {
+			if dsr.Digest == "" && dsr.PublicKey != "" {
+				key, err := makeDnskeyFromDelegationSignerRecord(domain, dsr)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%s\tIN\tDNSKEY\t%d %d %d %s ; id=%d created_at=%s\n", dns.Fqdn(domain), key.Flags, key.Protocol, key.Algorithm, key.PublicKey, dsr.ID, dsr.CreatedAt)
+				continue
+			}
+			fmt.Fprintf(w, "%s\tIN\tDS\t%s %s %s %s ; id=%d created_at=%s\n", dns.Fqdn(domain), dsr.Keytag, dsr.Algorithm, dsr.DigestType, dsr.Digest, dsr.ID, dsr.CreatedAt)
+		}
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(dsRecords.Data); err != nil {
+			return fmt.Errorf("error encoding DS records as JSON: %s", err)
+		}
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "keytag", "algorithm", "digest_type", "digest", "created_at", "public_key"})
+		for _, dsr := range dsRecords.Data {
+			cw.Write([]string{strconv.FormatInt(dsr.ID, 10), dsr.Keytag, dsr.Algorithm, dsr.DigestType, dsr.Digest, dsr.CreatedAt, dsr.PublicKey})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("error writing DS records as CSV: %s", err)
+		}
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+	if file != "" {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("error writing %s: %s", file, err)
+		}
+		if err := os.Rename(f.Name(), file); err != nil {
+			return fmt.Errorf("error writing %s: %s", file, err)
+		}
+		fmt.Printf("Exported %d DS records for domain %s to %s\n", len(dsRecords.Data), domain, file)
+	}
+	return nil
+}
+
+// readDsSet parses a file of DS records written by exportDsSet
+// Registry IDs and timestamps are ignored; they belong to the account the records were exported from
+// DNSKEY records are read as the DS of the configured digest type, as are keys in the csv public_key field
+// It takes three parameters, the domain, the format and the file to read from
+// It returns a slice of DS records and an error object
+func readDsSet(domain string, format string, file string) ([]dns.DS, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %s", file, err)
+	}
+	defer f.Close()
+
+	var rrs []dns.DS
+	switch format {
+	case "zone":
+		zp := dns.NewZoneParser(f, dns.Fqdn(domain), file)
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			if key, isKey := rr.(*dns.DNSKEY); isKey && strings.EqualFold(key.Hdr.Name, dns.Fqdn(domain)) {
+				ds := key.ToDS(config.dsDigestType)
+				if ds == nil {
+					return nil, fmt.Errorf("cannot compute a digest of type %d from the DNSKEY with keytag %d in %s", config.dsDigestType, key.KeyTag(), file)
+				}
+				rrs = append(rrs, *ds)
+				continue
+			}
+			ds, isDs := rr.(*dns.DS)
+			if !isDs {
+				_debug(fmt.Sprintf("skipping %s record in %s", dns.TypeToString[rr.Header().Rrtype], file))
+				continue
+			}
+			if !strings.EqualFold(ds.Hdr.Name, dns.Fqdn(domain)) {
+				return nil, fmt.Errorf("DS record for %s found in %s", ds.Hdr.Name, file)
+			}
+			rrs = append(rrs, *ds)
+		}
+		if err := zp.Err(); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", file, err)
+		}
+	case "json":
+		var records []dnsimple.DelegationSignerRecord
+		if err := json.NewDecoder(f).Decode(&records); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", file, err)
+		}
+		for _, dsr := range records {
+			ds, err := makeDsFromDelegationSignerRecord(domain, dsr)
+			if err != nil {
+				return nil, err
+			}
+			rrs = append(rrs, ds)
+		}
+	case "csv":
+		rows, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", file, err)
+		}
+		for i, row := range rows {
+			if i == 0 && row[0] == "id" {
+				continue
+			}
+			if len(row) < 5 {
+				return nil, fmt.Errorf("line %d of %s has %d fields; expected at least 5", i+1, file, len(row))
+			}
+			dsr := dnsimple.DelegationSignerRecord{Keytag: row[1], Algorithm: row[2], DigestType: row[3], Digest: row[4]}
+			if len(row) >= 7 {
+				dsr.PublicKey = row[6]
+			}
+			ds, err := makeDsFromDelegationSignerRecord(domain, dsr)
+			if err != nil {
+				return nil, err
+			}
+			rrs = append(rrs, ds)
+		}
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+	return rrs, nil
+}
+
+// importDsSet makes the DS records in the registry match those in a file
+// The differences between the file and the registry are shown and confirmed before any changes are made
+// It takes three parameters, the domain, the format and the file to read from
+// It returns an error object
+func importDsSet(domain string, format string, file string) error {
+	wanted, err := readDsSet(domain, format, file)
+	if err != nil {
+		return err
+	}
+	dsRecords, err := getDsFromRegistry(domain)
+	if err != nil {
+		return err
+	}
+
+	// records that can't be rebuilt can't be compared with the file, so are left alone
+	inRegistry := make(map[string]bool)
+	var known []dnsimple.DelegationSignerRecord
+	var unknown []dnsimple.DelegationSignerRecord
+	for _, dsr := range dsRecords.Data {
+		ds, err := makeDsFromDelegationSignerRecord(domain, dsr)
+		if errors.Is(err, errDsNotRebuilt) {
+			_debug(err.Error())
+			unknown = append(unknown, dsr)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		inRegistry[dsKey(ds)] = true
+		known = append(known, dsr)
+	}
+	inFile := make(map[string]bool)
+	var additions []dns.DS
+	for _, ds := range wanted {
+		if !inRegistry[dsKey(ds)] && !inFile[dsKey(ds)] {
+			additions = append(additions, ds)
+		}
+		inFile[dsKey(ds)] = true
+	}
+	var removals []dnsimple.DelegationSignerRecord
+	for _, dsr := range known {
+		ds, _ := makeDsFromDelegationSignerRecord(domain, dsr)
+		if !inFile[dsKey(ds)] {
+			removals = append(removals, dsr)
+		}
+	}
+
+	for _, dsr := range unknown {
+		fmt.Printf("  ? DS %5s %s (ID %d) cannot be compared with %s and is left alone\n", dsr.Keytag, dsr.Algorithm, dsr.ID, file)
+	}
+	if len(additions) == 0 && len(removals) == 0 {
+		fmt.Printf("The DS records in the registry already match %s\n", file)
+		return nil
+	}
+	for _, ds := range additions {
+		fmt.Printf("  + %s\n", formatDs(ds))
+	}
+	for _, dsr := range removals {
+		fmt.Printf("  - DS %5s %s %s %s (ID %d)\n", dsr.Keytag, dsr.Algorithm, dsr.DigestType, dsr.Digest, dsr.ID)
+	}
+	if len(wanted) == 0 {
+		fmt.Printf("Warning: %s contains no DS records; importing it will remove them all and make the domain insecure\n", file)
+	}
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to add %d and delete %d DS records?", len(additions), len(removals))) {
+		fmt.Println("Operation aborted")
+		return nil
+	}
+
+	// registries that take DNSKEY data need the published key rather than the DS
+	interfaceType, err := getTldDnssecInterfaceType(domain)
+	if err != nil {
+		return fmt.Errorf("cannot determine whether the registry takes DS or DNSKEY data: %s", err)
+	}
+	var keys []dns.RR
+	if interfaceType == "key" {
+		keys, _, err = getDnskeyRrsetFromDns(domain)
+		if err != nil {
+			return fmt.Errorf("error fetching DNSKEY records from DNS: %s", err)
+		}
+	}
+
+	// add before removing so that we don't leave a gap in the chain of trust
+	client := getApiClient()
+	var failed int
+	for _, ds := range additions {
+		delegationSigner := makeDelegationSignerRecordFromDs(ds)
+		if interfaceType == "key" {
+			var found bool
+			for _, rr := range keys {
+				if _, ok := dsMatchesDnskey(ds, rr.(*dns.DNSKEY)); ok {
+					delegationSigner = makeDelegationSignerRecordFromDnskey(*rr.(*dns.DNSKEY), interfaceType)
+					found = true
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "Error: the registry takes DNSKEY data but no published DNSKEY matches %s\n", formatDs(ds))
+				failed++
+				continue
+			}
+		}
+		dsResponse, err := client.Domains.CreateDelegationSignerRecord(context.Background(), config.accountNumber, domain, delegationSigner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error creating %s in the registry: %s\n", formatDs(ds), err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s created in the registry with ID %d\n", formatDs(ds), dsResponse.Data.ID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d additions failed, so no DS records have been deleted", failed, len(additions))
+	}
+	for _, dsr := range removals {
+		_, err := client.Domains.DeleteDelegationSignerRecord(context.Background(), config.accountNumber, domain, dsr.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error received from registrar API while deleting DS record (keytag %s, ID %d): %s\n", dsr.Keytag, dsr.ID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("DS record with keytag %s and ID %d in domain %s deleted\n", dsr.Keytag, dsr.ID, domain)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deletions failed", failed, len(removals))
+	}
+	return nil
+}
@@ -7,29 +7,59 @@ Copyright (c) 2024 Karl Dyson.
 All rights reserved.
 
 TODO (no particular order):
-* wait for functionality to alter glue and/or nameserver sets and/or delegation details
+* wait for functionality to alter glue
 
 */
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dnsimple/dnsimple-go/dnsimple"
+	"github.com/miekg/dns"
 )
 
+var dryrun bool
+
 // main collects the CLI flags,
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] <domain> [action]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <domain> [action] [nameserver ...]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Actions:\n")
 		fmt.Fprintf(os.Stderr, "\tlist:\tlist the delegation NS records in the registry\n")
+		fmt.Fprintf(os.Stderr, "\tcheck:\tcompare the registry, parent referral and child apex NS records and glue\n")
+		fmt.Fprintf(os.Stderr, "\thealth:\treport reachability, authority, SOA serial, EDNS, response time and NSID of each delegated nameserver\n")
+		fmt.Fprintf(os.Stderr, "\tset:\treplace the delegation NS records with the supplied nameservers\n")
+		fmt.Fprintf(os.Stderr, "\tadd:\tadd the supplied nameservers to the delegation NS records\n")
+		fmt.Fprintf(os.Stderr, "\tremove:\tremove the supplied nameservers from the delegation NS records\n")
+		fmt.Fprintf(os.Stderr, "\tmigrate:\tmigrate to the supplied nameservers in phases; re-run without nameservers to continue\n")
+		fmt.Fprintf(os.Stderr, "\tvanity:\tdelegate to the supplied vanity nameservers (default ns1 to ns4 in the domain)\n")
+		fmt.Fprintf(os.Stderr, "\tnovanity:\tdelegate back to the standard DNSimple nameservers\n")
 		fmt.Fprintf(os.Stderr, "\n")
 		flag.PrintDefaults()
 	}
 
+	flag.BoolVar(&dryrun, "dryrun", false, "dry run, just report actions")
+
+	var glueWait time.Duration
+	flag.DurationVar(&glueWait, "gluewait", 10*time.Minute, "how long to wait for glue to appear at the parent after a vanity change; 0 to check once")
+
+	var stateFile string
+	flag.StringVar(&stateFile, "state", "", "migration state file (default dnsimple-migrate-<domain>.json)")
+
 	// parse the CLI flags
 	flag.Parse()
+	setupOutput()
 
 	// set verbosity if debug is enabled
 	if *debugOutput && !*verboseOutput {
@@ -54,9 +84,10 @@ func main() {
 
 	// variables scoped to the main function
 	var (
-		domain string           // the domain we're processing
-		action string  = "list" // the action we're taking
-		errs   []error          // somewhere for errors
+		domain      string            // the domain we're processing
+		action      string   = "list" // the action we're taking
+		nameservers []string          // the nameservers we're processing
+		errs        []error           // somewhere for errors
 	)
 
 	// do we need to collect the returned value(s) ..? parsing the config can be done in the func only...?
@@ -69,7 +100,7 @@ func main() {
 	}
 
 	// switch the length of the CLI arguments left after CLI flag processing
-	// we're expecting <domain> and then optionally the <action> which will default to "list" and an optional <keytag>
+	// we're expecting <domain> and then optionally the <action> which will default to "list" and optional nameservers
 	switch len(flag.Args()) {
 	case 0:
 		fmt.Fprintf(os.Stderr, "Error: no domain supplied\n")
@@ -77,18 +108,14 @@ func main() {
 		os.Exit(1)
 	case 1:
 		domain = flag.Args()[0]
-	case 2:
+	default:
 		domain = flag.Args()[0]
 		action = flag.Args()[1]
-	default:
-		// and a default catching something weird
-		fmt.Fprintf(os.Stderr, "Error: invalid number of CLI parameters\n")
-		flag.Usage()
-		os.Exit(1)
+		nameservers = flag.Args()[2:]
 	}
 
 	// some debug to clarify the options we are operating with...
-	_debug(fmt.Sprintf("domain: %s, action: %s", domain, action))
+	_debug(fmt.Sprintf("domain: %s, action: %s, nameservers: %v", domain, action, nameservers))
 
 	// check the domain is in the account first
 	_, err := domainExistsInAccount(domain)
@@ -103,9 +130,1208 @@ func main() {
 	case "list":
 		fmt.Printf("Listing NS records in the registry for domain %s\n", domain)
 		listNsInRegistry(domain)
+	case "check":
+		fmt.Printf("Checking delegation consistency for domain %s\n", domain)
+		ok, err := checkDelegationConsistency(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error checking delegation for domain %s: %s\n", domain, err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	case "health":
+		fmt.Printf("Checking the health of the delegated nameservers for domain %s\n", domain)
+		ok, err := reportNameserverHealth(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error checking nameserver health for domain %s: %s\n", domain, err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	case "set", "add", "remove":
+		if len(nameservers) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: no nameservers supplied\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		err := changeDelegation(domain, action, nameservers)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error changing delegation for domain %s: %s\n", domain, err)
+			os.Exit(1)
+		}
+	case "migrate":
+		if stateFile == "" {
+			stateFile = fmt.Sprintf("dnsimple-migrate-%s.json", strings.TrimSuffix(domain, "."))
+		}
+		err := migrateNameservers(domain, nameservers, stateFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error migrating domain %s: %s\n", domain, err)
+			os.Exit(1)
+		}
+	case "vanity":
+		if len(nameservers) == 0 {
+			for i := 1; i <= 4; i++ {
+				nameservers = append(nameservers, fmt.Sprintf("ns%d.%s", i, strings.TrimSuffix(domain, ".")))
+			}
+		}
+		err := changeDelegationToVanity(domain, nameservers, glueWait)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error changing delegation for domain %s to vanity nameservers: %s\n", domain, err)
+			os.Exit(1)
+		}
+	case "novanity":
+		err := changeDelegationFromVanity(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: error changing delegation for domain %s from vanity nameservers: %s\n", domain, err)
+			os.Exit(1)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "Error: unknown action: %s\n", action)
 		flag.Usage()
 		os.Exit(1)
 	}
 }
+
+// changeDelegation works out the new set of delegation nameservers, checks them, and once confirmed,
+// submits them to the registry
+// It takes three parameters, the domain, the action (set, add or remove) and the nameservers supplied
+// It returns an error object
+func changeDelegation(domain string, action string, nameservers []string) error {
+	nsRecords, err := getNsFromRegistry(domain)
+	if err != nil {
+		return err
+	}
+	current := normaliseNameservers(*nsRecords.Data)
+	supplied := normaliseNameservers(nameservers)
+
+	var proposed []string
+	switch action {
+	case "set":
+		proposed = supplied
+	case "add":
+		proposed = normaliseNameservers(append(current, supplied...))
+	case "remove":
+		removing := make(map[string]bool)
+		for _, ns := range supplied {
+			removing[ns] = true
+		}
+		for _, ns := range current {
+			if !removing[ns] {
+				proposed = append(proposed, ns)
+			}
+		}
+	}
+	if len(proposed) == 0 {
+		return fmt.Errorf("this would leave the domain with no nameservers")
+	}
+	if strings.Join(proposed, " ") == strings.Join(current, " ") {
+		fmt.Printf("The delegation for %s is already %s; nothing to do\n", domain, strings.Join(current, " "))
+		return nil
+	}
+
+	fmt.Printf("Current NS records.: %s\n", strings.Join(current, " "))
+	fmt.Printf("Proposed NS records: %s\n", strings.Join(proposed, " "))
+
+	findings := checkProposedNameservers(domain, proposed)
+	warnings, errs := reportPreflightFindings(findings, "change")
+
+	if dryrun {
+		fmt.Printf("= Dryrun, no alterations made\n")
+		return nil
+	}
+
+	proceed, err := preflightAllows(warnings, errs, true)
+	if err != nil {
+		return err
+	}
+	if !proceed || (warnings+errs == 0 && !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to change the delegation for %s?", domain))) {
+		fmt.Println("Operation aborted")
+		return nil
+	}
+
+	var submit []string
+	for _, ns := range proposed {
+		submit = append(submit, strings.TrimSuffix(ns, "."))
+	}
+	r, err := changeNsInRegistry(domain, submit)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Delegation for %s changed to %s\n", domain, strings.Join(*r.Data, " "))
+	fmt.Println("Note that it may take some time for the change to appear in DNS.")
+	return nil
+}
+
+// changeDelegationToVanity delegates a domain to vanity nameservers
+// Vanity nameservers are enabled for the zone first, so that the glue that will be needed for nameservers
+// within the domain can be shown with the addresses DNSimple will use, and once the change is made, the
+// parent is polled until it serves that glue
+// It takes three parameters, the domain, the vanity nameserver names, and how long to wait for the glue
+// It returns an error object
+func changeDelegationToVanity(domain string, nameservers []string, glueWait time.Duration) error {
+	nsRecords, err := getNsFromRegistry(domain)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Current NS records.: %s\n", strings.Join(normaliseNameservers(*nsRecords.Data), " "))
+	fmt.Printf("Proposed NS records: %s\n", strings.Join(normaliseNameservers(nameservers), " "))
+
+	// the addresses only come from DNSimple once vanity nameservers are enabled for the zone, which
+	// changes the zone's apex NS records, so it isn't done on a dry run
+	if dryrun {
+		fmt.Printf("Glue records to be created at the parent, with addresses allocated by DNSimple:\n")
+		for _, ns := range normaliseNameservers(nameservers) {
+			if isInBailiwick(ns, domain) {
+				fmt.Printf("  => %s\n", ns)
+			}
+		}
+		fmt.Printf("= Dryrun, no alterations made\n")
+		return nil
+	}
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Vanity nameservers must be enabled for %s to see the glue addresses; enable them now?", domain)) {
+		fmt.Println("Operation aborted")
+		return nil
+	}
+	client := getApiClient()
+	enabled, err := client.VanityNameServers.EnableVanityNameServers(context.Background(), config.accountNumber, domain)
+	if err != nil {
+		return fmt.Errorf("error enabling vanity nameservers: %s", err)
+	}
+
+	var problems int
+	fmt.Printf("Glue records to be created at the parent:\n")
+	for _, ns := range normaliseNameservers(nameservers) {
+		if !isInBailiwick(ns, domain) {
+			_verbose(fmt.Sprintf("%s is not within %s, so needs no glue", ns, domain))
+			continue
+		}
+		var found bool
+		for _, v := range enabled.Data {
+			if strings.EqualFold(dns.Fqdn(v.Name), ns) {
+				fmt.Printf("  => %s: %s %s\n", ns, v.IPv4, v.IPv6)
+				found = true
+			}
+		}
+		if !found {
+			fmt.Printf("  => %s: DNSimple has no vanity nameserver of this name, so has no address for it\n", ns)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		if *forceOperation {
+			_debug("there are warnings, but the -force flag overrides")
+		} else if !askUserYesNo("Given the warnings, do you want to proceed?") {
+			fmt.Println("Operation aborted; vanity nameservers remain enabled for the zone")
+			return nil
+		}
+	} else if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to delegate %s to vanity nameservers?", domain)) {
+		fmt.Println("Operation aborted; vanity nameservers remain enabled for the zone")
+		return nil
+	}
+
+	var submit []string
+	for _, ns := range normaliseNameservers(nameservers) {
+		submit = append(submit, strings.TrimSuffix(ns, "."))
+	}
+	delegation := dnsimple.Delegation(submit)
+	r, err := client.Registrar.ChangeDomainDelegationToVanity(context.Background(), config.accountNumber, domain, &delegation)
+	if err != nil {
+		return fmt.Errorf("error from registrar API: %s", err)
+	}
+	fmt.Printf("Delegation for %s changed to vanity nameservers:\n", domain)
+	for _, v := range r.Data {
+		fmt.Printf("  => %s: %s %s\n", v.Name, v.IPv4, v.IPv6)
+	}
+	waitForGlueAtParent(domain, r.Data, glueWait)
+	return nil
+}
+
+// changeDelegationFromVanity delegates a domain back to the standard DNSimple nameservers, and then
+// disables vanity nameservers for the zone, which are no longer needed once the delegation has moved
+// It takes one parameter, the domain
+// It returns an error object
+func changeDelegationFromVanity(domain string) error {
+	nsRecords, err := getNsFromRegistry(domain)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Current NS records: %s\n", strings.Join(normaliseNameservers(*nsRecords.Data), " "))
+	for _, ns := range normaliseNameservers(*nsRecords.Data) {
+		if isInBailiwick(ns, domain) {
+			fmt.Printf("  => glue for %s will be removed from the parent\n", ns)
+		}
+	}
+	if dryrun {
+		fmt.Printf("= Dryrun, no alterations made\n")
+		return nil
+	}
+	if !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to delegate %s back to the standard nameservers?", domain)) {
+		fmt.Println("Operation aborted")
+		return nil
+	}
+	client := getApiClient()
+	_, err = client.Registrar.ChangeDomainDelegationFromVanity(context.Background(), config.accountNumber, domain)
+	if err != nil {
+		return fmt.Errorf("error from registrar API: %s", err)
+	}
+	nsRecords, err = getNsFromRegistry(domain)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Delegation for %s changed to %s\n", domain, strings.Join(normaliseNameservers(*nsRecords.Data), " "))
+	if _, err := client.VanityNameServers.DisableVanityNameServers(context.Background(), config.accountNumber, domain); err != nil {
+		return fmt.Errorf("the delegation has changed, but disabling vanity nameservers failed: %s", err)
+	}
+	fmt.Printf("Vanity nameservers disabled for %s\n", domain)
+	return nil
+}
+
+// waitForGlueAtParent polls the parent until it serves the glue for the vanity nameservers, or the time
+// runs out; the delegation has already changed by then, so glue that hasn't appeared yet is reported as
+// pending rather than as a failure
+// It takes three parameters, the domain, the vanity nameservers returned by the registrar, and how long to wait
+func waitForGlueAtParent(domain string, vanity []dnsimple.VanityNameServer, wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	if wait > 0 {
+		fmt.Printf("Waiting up to %s for the glue to appear at the parent\n", wait)
+	}
+	for {
+		present, err := verifyGlueAtParent(domain, vanity)
+		if err != nil {
+			fmt.Printf("  => %s\n", err)
+		} else if present {
+			return
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			fmt.Printf("Glue at the parent is still pending; it may take some time to appear, which can be checked with the check action\n")
+			return
+		}
+		time.Sleep(min(pollInterval, remaining))
+	}
+}
+
+// verifyGlueAtParent checks the referral from the parent zone carries glue for each vanity nameserver
+// within the domain, with the addresses the registrar reported
+// It takes two parameters, the domain and the vanity nameservers returned by the registrar
+// It returns whether all the glue is present, and an error object should the check not be able to be made
+func verifyGlueAtParent(domain string, vanity []dnsimple.VanityNameServer) (bool, error) {
+	_, glue, server, err := getReferralFromParent(domain)
+	if err != nil {
+		return false, fmt.Errorf("cannot verify glue at the parent: %s", err)
+	}
+	fmt.Printf("Checking glue at the parent (%s):\n", server)
+	var problems int
+	for _, v := range vanity {
+		name := strings.ToLower(dns.Fqdn(v.Name))
+		if !isInBailiwick(name, domain) {
+			continue
+		}
+		for _, addr := range []string{v.IPv4, v.IPv6} {
+			if addr == "" {
+				continue
+			}
+			var found bool
+			for _, g := range glue[name] {
+				if net.ParseIP(g).Equal(net.ParseIP(addr)) {
+					found = true
+				}
+			}
+			if found {
+				fmt.Printf("  => %s %s is present\n", name, addr)
+			} else {
+				fmt.Printf("  => %s %s is NOT yet present\n", name, addr)
+				problems++
+			}
+		}
+	}
+	return problems == 0, nil
+}
+
+// checkDelegationConsistency compares the NS records in the registry, the NS records in the parent's
+// referral and the apex NS records served by the child, and compares the glue in the referral against
+// the A and AAAA records the child serves for those names
+// It takes one parameter, the domain
+// It returns a bool indicating whether everything lines up, and an error object should the checks
+// not be able to be carried out
+func checkDelegationConsistency(domain string) (bool, error) {
+	nsRecords, err := getNsFromRegistry(domain)
+	if err != nil {
+		return false, err
+	}
+	registry := normaliseNameservers(*nsRecords.Data)
+
+	referral, glue, parentServer, err := getReferralFromParent(domain)
+	if err != nil {
+		return false, err
+	}
+
+	// find a child server that answers authoritatively, using glue where we have it
+	var childServer string
+	var apex []string
+	for _, ns := range referral {
+		addrs := glue[ns]
+		if len(addrs) == 0 {
+			addrs, _ = getAddressesFromDns(ns)
+		}
+		for _, addr := range addrs {
+			server := net.JoinHostPort(addr, "53")
+			r, err := doQueryToServer(server, domain, dns.TypeNS, false)
+			if err != nil || r == nil || !r.Authoritative {
+				_debug(fmt.Sprintf("Warning: %s (%s) did not answer authoritatively for %s/NS", ns, addr, domain))
+				continue
+			}
+			for _, ans := range r.Answer {
+				if rr, ok := ans.(*dns.NS); ok {
+					apex = append(apex, rr.Ns)
+				}
+			}
+			childServer = server
+			break
+		}
+		if childServer != "" {
+			break
+		}
+	}
+	if childServer == "" {
+		return false, fmt.Errorf("none of the delegated nameservers answer authoritatively for %s", domain)
+	}
+	apex = normaliseNameservers(apex)
+
+	fmt.Printf("Registry NS......: %s\n", strings.Join(registry, " "))
+	fmt.Printf("Parent referral..: %s (from %s)\n", strings.Join(referral, " "), parentServer)
+	fmt.Printf("Child apex NS....: %s (from %s)\n", strings.Join(apex, " "), childServer)
+
+	var problems []string
+	if strings.Join(registry, " ") != strings.Join(referral, " ") {
+		problems = append(problems, "The NS records in the registry do not match those in the parent referral")
+	}
+	if strings.Join(referral, " ") != strings.Join(apex, " ") {
+		problems = append(problems, "The NS records in the parent referral do not match those at the child apex")
+	}
+
+	// glue; every in-bailiwick nameserver needs it, and it should match what the child serves
+	inReferral := make(map[string]bool)
+	for _, ns := range referral {
+		inReferral[ns] = true
+		if !isInBailiwick(ns, domain) {
+			continue
+		}
+		if len(glue[ns]) == 0 {
+			problems = append(problems, fmt.Sprintf("Glue for %s is missing from the parent referral", ns))
+			continue
+		}
+		var authAddrs []string
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			r, err := doQueryToServer(childServer, ns, qtype, false)
+			if err != nil || r == nil {
+				continue
+			}
+			for _, ans := range r.Answer {
+				switch rr := ans.(type) {
+				case *dns.A:
+					authAddrs = append(authAddrs, rr.A.String())
+				case *dns.AAAA:
+					authAddrs = append(authAddrs, rr.AAAA.String())
+				}
+			}
+		}
+		sort.Strings(authAddrs)
+		glueAddrs := append([]string(nil), glue[ns]...)
+		sort.Strings(glueAddrs)
+		fmt.Printf("Glue for %s: %s; authoritative: %s\n", ns, strings.Join(glueAddrs, " "), strings.Join(authAddrs, " "))
+		for _, g := range glueAddrs {
+			if !containsAddress(authAddrs, g) {
+				problems = append(problems, fmt.Sprintf("Glue %s %s is stale; the child does not serve that address", ns, g))
+			}
+		}
+		for _, a := range authAddrs {
+			if !containsAddress(glueAddrs, a) {
+				problems = append(problems, fmt.Sprintf("Glue for %s is missing address %s served by the child", ns, a))
+			}
+		}
+	}
+	for name := range glue {
+		if !inReferral[name] {
+			problems = append(problems, fmt.Sprintf("Glue for %s is stale; it is not one of the delegated nameservers", name))
+		}
+	}
+
+	fmt.Println()
+	switch len(problems) {
+	case 0:
+		fmt.Printf("There are no problems; the delegation is consistent\n")
+	case 1:
+		fmt.Printf("There is a problem:\n")
+	default:
+		fmt.Printf("There are %d problems:\n", len(problems))
+	}
+	for _, p := range problems {
+		fmt.Printf("  => %s\n", p)
+	}
+	return len(problems) == 0, nil
+}
+
+// containsAddress determines whether an IP address is in a list of addresses, allowing for different textual forms
+func containsAddress(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if net.ParseIP(a).Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameserverHealth holds the results of probing one address of one nameserver
+type nameserverHealth struct {
+	Name          string        `json:"name"`
+	Address       string        `json:"address"`
+	Family        string        `json:"family"`
+	UDP           bool          `json:"udp"`
+	TCP           bool          `json:"tcp"`
+	Authoritative bool          `json:"authoritative"`
+	Serial        uint32        `json:"serial"`
+	SerialLags    bool          `json:"serial_lags"`
+	EDNS          bool          `json:"edns"`
+	RTT           time.Duration `json:"-"`
+	RTTMs         float64       `json:"rtt_ms"` // the RTT in milliseconds, as a duration would be nanoseconds in JSON
+	NSID          string        `json:"nsid,omitempty"`
+	Problems      []string      `json:"problems,omitempty"`
+}
+
+// probeTimeout is how long each probe waits for a response
+var probeTimeout = 5 * time.Second
+
+// probeNameserver probes a single nameserver address for a zone
+// It checks UDP and TCP reachability, the AA bit, the SOA serial, EDNS compliance (including the
+// BADVERS response to an unknown EDNS version), the response time and the NSID
+// It takes three parameters, the zone, the nameserver name and the server (as host:port) so that it
+// can be pointed at a local test server
+// It returns the results of the probes
+func probeNameserver(zone string, name string, server string) nameserverHealth {
+	h := nameserverHealth{Name: name, Address: server, Family: "IPv4"}
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			h.Family = "IPv6"
+		}
+	}
+
+	// UDP, with EDNS and NSID requested; this is the query we take the serial, AA and RTT from
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	m.RecursionDesired = false
+	m.SetEdns0(1232, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	c := &dns.Client{Net: "udp", Timeout: probeTimeout}
+	r, rtt, err := c.Exchange(m, server)
+	if err != nil || r == nil {
+		h.Problems = append(h.Problems, fmt.Sprintf("no response over UDP: %s", err))
+	} else {
+		h.UDP = true
+		h.RTT = rtt
+		h.RTTMs = float64(rtt.Microseconds()) / 1000
+		h.Authoritative = r.Authoritative
+		if !r.Authoritative {
+			h.Problems = append(h.Problems, "response is not authoritative (lame)")
+		}
+		for _, ans := range r.Answer {
+			if soa, ok := ans.(*dns.SOA); ok {
+				h.Serial = soa.Serial
+			}
+		}
+		if opt := r.IsEdns0(); opt != nil {
+			h.EDNS = true
+			for _, o := range opt.Option {
+				if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+					if b, err := hex.DecodeString(nsid.Nsid); err == nil {
+						h.NSID = string(b)
+					} else {
+						h.NSID = nsid.Nsid
+					}
+				}
+			}
+		} else {
+			h.Problems = append(h.Problems, "no OPT record in response to an EDNS query")
+		}
+	}
+
+	// TCP
+	c = &dns.Client{Net: "tcp", Timeout: probeTimeout}
+	m = new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	m.RecursionDesired = false
+	if r, _, err := c.Exchange(m, server); err != nil || r == nil {
+		h.Problems = append(h.Problems, fmt.Sprintf("no response over TCP: %s", err))
+	} else {
+		h.TCP = true
+	}
+
+	// an unknown EDNS version should get BADVERS with an OPT of version 0 (RFC 6891)
+	if h.EDNS {
+		m = new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+		m.RecursionDesired = false
+		m.SetEdns0(1232, false)
+		m.IsEdns0().SetVersion(1)
+		c = &dns.Client{Net: "udp", Timeout: probeTimeout}
+		r, _, err := c.Exchange(m, server)
+		switch {
+		case err != nil || r == nil:
+			h.EDNS = false
+			h.Problems = append(h.Problems, fmt.Sprintf("no response to an EDNS version 1 query: %s", err))
+		case r.Rcode != dns.RcodeBadVers || r.IsEdns0() == nil || r.IsEdns0().Version() != 0:
+			h.EDNS = false
+			h.Problems = append(h.Problems, fmt.Sprintf("responded to an EDNS version 1 query with %s rather than BADVERS", dns.RcodeToString[r.Rcode]))
+		}
+	}
+	return h
+}
+
+// markLaggingSerials works out whether any authoritative nameserver's SOA serial lags behind the most
+// recent, using serial number arithmetic, and notes it as a problem
+// It takes one parameter, the probe results, which are updated in place
+// It returns a bool indicating whether all the results are free of problems
+func markLaggingSerials(results []nameserverHealth) bool {
+	var latest uint32
+	var haveSerial bool
+	for _, h := range results {
+		if !h.Authoritative {
+			continue
+		}
+		if !haveSerial || int32(h.Serial-latest) > 0 {
+			latest = h.Serial
+			haveSerial = true
+		}
+	}
+	healthy := true
+	for i := range results {
+		if results[i].Authoritative && results[i].Serial != latest {
+			results[i].SerialLags = true
+			results[i].Problems = append(results[i].Problems, fmt.Sprintf("SOA serial %d lags behind %d", results[i].Serial, latest))
+		}
+		if len(results[i].Problems) > 0 {
+			healthy = false
+		}
+	}
+	return healthy
+}
+
+// reportNameserverHealth probes every address of every nameserver in the delegation and reports the results
+// in the format requested with -output
+// It takes one parameter, the domain
+// It returns a bool indicating whether all the nameservers are healthy, and an error object
+func reportNameserverHealth(domain string) (bool, error) {
+	nsRecords, err := getNsFromRegistry(domain)
+	if err != nil {
+		return false, err
+	}
+
+	var results []nameserverHealth
+	for _, ns := range normaliseNameservers(*nsRecords.Data) {
+		addrs, err := getAddressesFromDns(ns)
+		if err != nil {
+			results = append(results, nameserverHealth{Name: ns, Problems: []string{fmt.Sprintf("cannot be resolved: %s", err)}})
+			continue
+		}
+		var hasV6 bool
+		for _, addr := range addrs {
+			h := probeNameserver(domain, ns, net.JoinHostPort(addr, "53"))
+			if h.Family == "IPv6" {
+				hasV6 = true
+			}
+			results = append(results, h)
+		}
+		if !hasV6 {
+			_verbose(fmt.Sprintf("%s has no IPv6 address", ns))
+		}
+	}
+
+	healthy := markLaggingSerials(results)
+
+	if *outputFormat == "json" {
+		out, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return false, fmt.Errorf("error encoding results as JSON: %s", err)
+		}
+		fmt.Fprintln(reportOutput, string(out))
+		return healthy, nil
+	}
+
+	for _, h := range results {
+		fmt.Printf("  => %s (%s)\n", h.Name, h.Address)
+		if h.Address == "" {
+			for _, p := range h.Problems {
+				fmt.Printf("     problem: %s\n", p)
+			}
+			continue
+		}
+		fmt.Printf("     %s; UDP: %v; TCP: %v; AA: %v; serial: %d; EDNS: %v; RTT: %s; NSID: %s\n", h.Family, h.UDP, h.TCP, h.Authoritative, h.Serial, h.EDNS, h.RTT, h.NSID)
+		for _, p := range h.Problems {
+			fmt.Printf("     problem: %s\n", p)
+		}
+	}
+	if healthy {
+		fmt.Printf("All nameservers are healthy\n")
+	} else {
+		fmt.Printf("One or more nameservers have problems\n")
+	}
+	return healthy, nil
+}
+
+// migrationState is saved between runs of the migrate action
+// Phase is the last phase completed; 0 means none have been
+type migrationState struct {
+	Domain    string    `json:"domain"`
+	OldNS     []string  `json:"old_ns"`
+	NewNS     []string  `json:"new_ns"`
+	Phase     int       `json:"phase"`
+	AddedAt   time.Time `json:"added_at,omitempty"`
+	ParentTTL uint32    `json:"parent_ttl,omitempty"`
+}
+
+// loadMigrationState reads the migration state from a file
+// It returns nil, without an error, if the file does not exist
+func loadMigrationState(file string) (*migrationState, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", file, err)
+	}
+	var state migrationState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", file, err)
+	}
+	return &state, nil
+}
+
+// saveMigrationState writes the migration state to a file
+func saveMigrationState(file string, state *migrationState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding migration state: %s", err)
+	}
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		return fmt.Errorf("error writing %s: %s", file, err)
+	}
+	_debug(fmt.Sprintf("migration state saved to %s at phase %d", file, state.Phase))
+	return nil
+}
+
+// migrateNameservers moves a domain from one DNS operator to another in phases, saving state between runs:
+// 1. verify the new operator serves a zone equivalent to the old one, and if the zone is signed,
+// that the zone signing keys have been pre-published
+// 2. add a DS for each of the new operator's KSKs that doesn't have one
+// 3. add the new nameservers alongside the old in the delegation
+// 4. wait for the parent to publish the combined nameservers, and then for its NS TTL to pass
+// 5. remove the old nameservers from the delegation
+// It takes three parameters, the domain, the new nameservers (only needed on the first run) and the state file
+// It returns an error object
+func migrateNameservers(domain string, nameservers []string, stateFile string) error {
+	state, err := loadMigrationState(stateFile)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		if len(nameservers) == 0 {
+			return fmt.Errorf("no migration in progress in %s, and no new nameservers supplied", stateFile)
+		}
+		nsRecords, err := getNsFromRegistry(domain)
+		if err != nil {
+			return err
+		}
+		state = &migrationState{Domain: domain, OldNS: normaliseNameservers(*nsRecords.Data), NewNS: normaliseNameservers(nameservers)}
+		fmt.Printf("Starting migration of %s; state will be saved in %s\n", domain, stateFile)
+	} else {
+		if state.Domain != domain {
+			return fmt.Errorf("%s holds a migration for %s, not %s", stateFile, state.Domain, domain)
+		}
+		if len(nameservers) > 0 && strings.Join(normaliseNameservers(nameservers), " ") != strings.Join(state.NewNS, " ") {
+			return fmt.Errorf("a migration to %s is already in progress in %s", strings.Join(state.NewNS, " "), stateFile)
+		}
+		fmt.Printf("Continuing migration of %s from phase %d\n", domain, state.Phase+1)
+	}
+	fmt.Printf("Old NS records: %s\n", strings.Join(state.OldNS, " "))
+	fmt.Printf("New NS records: %s\n", strings.Join(state.NewNS, " "))
+
+	// a dry run walks through the phases without making changes, so the state isn't saved either
+	save := func() error {
+		if dryrun {
+			_debug("dry run, so migration state not saved")
+			return nil
+		}
+		return saveMigrationState(stateFile, state)
+	}
+
+	for state.Phase < 5 {
+		var done bool
+		switch state.Phase + 1 {
+		case 1:
+			fmt.Printf("\n== Phase 1: verifying the new operator's zone\n")
+			done, err = migrationVerifyZone(state)
+		case 2:
+			fmt.Printf("\n== Phase 2: pre-publishing DS records for the new operator's keys\n")
+			done, err = migrationPublishDs(state)
+		case 3:
+			fmt.Printf("\n== Phase 3: adding the new nameservers alongside the old\n")
+			done, err = migrationChangeDelegation(state, migrationCombinedNs(state))
+		case 4:
+			fmt.Printf("\n== Phase 4: waiting for the parent's NS TTL\n")
+			// the TTL clock only starts once the parent publishes the combined set, as until then
+			// resolvers can't have seen it
+			if state.AddedAt.IsZero() {
+				done, err = migrationCheckParent(state)
+				if err != nil || !done {
+					break
+				}
+			}
+			ready := state.AddedAt.Add(time.Duration(state.ParentTTL) * time.Second)
+			if time.Now().Before(ready) {
+				fmt.Printf("The parent's NS TTL is %ds; re-run after %s (%s from now)\n", state.ParentTTL, ready.Format(time.RFC3339), time.Until(ready).Round(time.Second))
+				return save()
+			}
+			fmt.Printf("The parent's NS TTL of %ds has passed\n", state.ParentTTL)
+			done = true
+		case 5:
+			fmt.Printf("\n== Phase 5: removing the old nameservers\n")
+			done, err = migrationChangeDelegation(state, state.NewNS)
+		}
+		if err != nil {
+			if saveErr := save(); saveErr != nil {
+				return fmt.Errorf("%s; and %s", err, saveErr)
+			}
+			return err
+		}
+		if !done {
+			return save()
+		}
+		state.Phase++
+		if err := save(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("\nMigration of %s is complete\n", domain)
+	if parentDs, _, err := getDsFromParent(domain); err == nil && len(parentDs) > 0 {
+		fmt.Printf("Once the DS and DNSKEY TTLs have passed, remove the old operator's keys and then any stale DS records with dnsimple-ds %s prune\n", domain)
+	}
+	return nil
+}
+
+// migrationVerifyZone is phase 1 of migrateNameservers
+// It compares the RRsets served by the old and new operators; the old operator is asked for a zone
+// transfer, and if that is refused, a sample of common names and types is compared instead
+// It returns a bool indicating whether the phase is complete, and an error object
+func migrationVerifyZone(state *migrationState) (bool, error) {
+	oldServer, err := findAuthoritativeServer(state.Domain, state.OldNS)
+	if err != nil {
+		return false, fmt.Errorf("old operator: %s", err)
+	}
+	newServer, err := findAuthoritativeServer(state.Domain, state.NewNS)
+	if err != nil {
+		return false, fmt.Errorf("new operator: %s", err)
+	}
+	fmt.Printf("Comparing %s (old) with %s (new)\n", oldServer, newServer)
+
+	var problems []string
+	rrsets, err := transferZone(state.Domain, oldServer)
+	if err != nil {
+		fmt.Printf("Warning: zone transfer from the old operator failed (%s); comparing a sample of records only\n", err)
+		rrsets = make(map[string][]string)
+		for _, name := range []string{state.Domain, "www." + state.Domain, "mail." + state.Domain} {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeTXT, dns.TypeCAA, dns.TypeCNAME, dns.TypeSRV} {
+				rrs, err := queryRrset(oldServer, name, qtype)
+				if err == nil && len(rrs) > 0 {
+					rrsets[rrsetKey(name, qtype)] = rrs
+				}
+			}
+		}
+	}
+
+	var compared int
+	for key, oldRrs := range rrsets {
+		parts := strings.SplitN(key, "/", 2)
+		qtype := dns.StringToType[parts[1]]
+		newRrs, err := queryRrset(newServer, parts[0], qtype)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s could not be fetched from the new operator: %s", key, err))
+			continue
+		}
+		compared++
+		if strings.Join(oldRrs, "\n") != strings.Join(newRrs, "\n") {
+			problems = append(problems, fmt.Sprintf("%s differs; old: %s; new: %s", key, strings.Join(oldRrs, " | "), strings.Join(newRrs, " | ")))
+		}
+	}
+	fmt.Printf("Compared %d RRsets\n", compared)
+
+	// the new operator's apex NS should list its own nameservers
+	apex, err := queryRrset(newServer, state.Domain, dns.TypeNS)
+	if err == nil {
+		served := make(map[string]bool)
+		for _, rr := range apex {
+			fields := strings.Fields(rr)
+			served[strings.ToLower(fields[len(fields)-1])] = true
+		}
+		for _, ns := range state.NewNS {
+			if !served[ns] {
+				problems = append(problems, fmt.Sprintf("The new operator's apex NS records do not include %s", ns))
+			}
+		}
+	}
+
+	problems = append(problems, migrationCheckKeys(state.Domain, oldServer, newServer)...)
+
+	switch len(problems) {
+	case 0:
+		fmt.Printf("The new operator's zone is equivalent to the old one\n")
+		return true, nil
+	case 1:
+		fmt.Printf("There is a problem:\n")
+	default:
+		fmt.Printf("There are %d problems:\n", len(problems))
+	}
+	for _, p := range problems {
+		fmt.Printf("  => %s\n", p)
+	}
+	if *forceOperation {
+		_debug("there are problems, but the -force flag overrides")
+		return true, nil
+	}
+	fmt.Printf("Resolve these and re-run, or use -force to carry on regardless\n")
+	return false, nil
+}
+
+// migrationCheckKeys checks DNSSEC pre-publication for a signed zone moving between operators
+// Each operator's DNSKEY RRset must include the other's zone signing keys, so that signatures from
+// either validate whichever nameserver a resolver asks
+// It takes three parameters, the domain and a server for each of the old and new operators
+// It returns a list of problems
+func migrationCheckKeys(domain string, oldServer string, newServer string) []string {
+	oldKeys := queryDnskeys(oldServer, domain)
+	newKeys := queryDnskeys(newServer, domain)
+	if len(oldKeys) == 0 && len(newKeys) == 0 {
+		_verbose("Neither operator serves DNSKEY records; the zone is not signed")
+		return nil
+	}
+	var problems []string
+	for _, k := range newKeys {
+		if k.Flags&dns.SEP == 0 && !containsKey(oldKeys, k) {
+			problems = append(problems, fmt.Sprintf("The old operator does not yet publish the new operator's ZSK %d", k.KeyTag()))
+		}
+	}
+	for _, k := range oldKeys {
+		if k.Flags&dns.SEP == 0 && !containsKey(newKeys, k) {
+			problems = append(problems, fmt.Sprintf("The new operator does not yet publish the old operator's ZSK %d", k.KeyTag()))
+		}
+	}
+	return problems
+}
+
+// migrationPublishDs is phase 2 of migrateNameservers
+// If the new operator signs the zone, the registry must hold a DS for each of its KSKs before its
+// nameservers are added; any that are missing are added after the same checks as dnsimple-ds
+// It returns a bool indicating whether the phase is complete, and an error object
+func migrationPublishDs(state *migrationState) (bool, error) {
+	newServer, err := findAuthoritativeServer(state.Domain, state.NewNS)
+	if err != nil {
+		return false, fmt.Errorf("new operator: %s", err)
+	}
+	var ksks []dns.DNSKEY
+	for _, k := range queryDnskeys(newServer, state.Domain) {
+		if k.Flags&dns.SEP != 0 && k.Flags&dns.REVOKE == 0 {
+			ksks = append(ksks, k)
+		}
+	}
+	if len(ksks) == 0 {
+		fmt.Printf("The new operator publishes no KSKs; no DS records needed\n")
+		return true, nil
+	}
+
+	dsRecords, err := getDsFromRegistry(state.Domain)
+	if err != nil {
+		return false, err
+	}
+	var existingDs []dns.DS
+	for _, dsr := range dsRecords.Data {
+		if ds, err := makeDsFromDelegationSignerRecord(state.Domain, dsr); err == nil {
+			existingDs = append(existingDs, ds)
+		}
+	}
+	var missing []dns.DNSKEY
+	for _, k := range ksks {
+		var hasDs bool
+		for _, ds := range existingDs {
+			if _, ok := dsMatchesDnskey(ds, &k); ok {
+				hasDs = true
+			}
+		}
+		if hasDs {
+			fmt.Printf("  => DS for the new operator's KSK %d is already in the registry\n", k.KeyTag())
+			continue
+		}
+		missing = append(missing, k)
+	}
+	if len(missing) == 0 {
+		return true, nil
+	}
+
+	interfaceType, err := getTldDnssecInterfaceType(state.Domain)
+	if err != nil {
+		return false, fmt.Errorf("cannot determine whether the registry takes DS or DNSKEY data: %s", err)
+	}
+	for _, k := range missing {
+		keytag := k.KeyTag()
+		fmt.Printf("There is no DS for the new operator's KSK %d\n", keytag)
+		findings, err := getPreflightFindings(state.Domain, k)
+		if err != nil {
+			return false, err
+		}
+		warnings, errs := reportPreflightFindings(findings, "addition")
+		if dryrun {
+			fmt.Printf("= Dryrun, no alterations made\n")
+			continue
+		}
+		proceed, err := preflightAllows(warnings, errs, true)
+		if err != nil {
+			return false, fmt.Errorf("the DS for keytag %d: %s", keytag, err)
+		}
+		if !proceed || (warnings+errs == 0 && !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to add a DS for the new operator's KSK %d?", keytag))) {
+			fmt.Println("Operation aborted")
+			return false, nil
+		}
+		r, err := addDelegationSignerRecordToRegistry(state.Domain, makeDelegationSignerRecordFromDnskey(k, interfaceType))
+		if err != nil {
+			return false, fmt.Errorf("error creating DS record for keytag %d: %s", keytag, err)
+		}
+		fmt.Printf("DS record with keytag %d created in domain %s in the registry with ID %d\n", keytag, state.Domain, r.Data.ID)
+	}
+	return !dryrun, nil
+}
+
+// migrationCombinedNs returns the old and new nameservers together, as delegated during the migration
+func migrationCombinedNs(state *migrationState) []string {
+	return normaliseNameservers(append(append([]string(nil), state.OldNS...), state.NewNS...))
+}
+
+// migrationCheckParent is the first part of phase 4 of migrateNameservers
+// It checks the parent's referral lists the combined nameservers, and if so, notes the time and the
+// parent's NS TTL so the wait can begin
+// It returns a bool indicating whether the parent publishes the combined set, and an error object
+func migrationCheckParent(state *migrationState) (bool, error) {
+	referral, _, server, err := getReferralFromParent(state.Domain)
+	if err != nil {
+		return false, err
+	}
+	published := make(map[string]bool)
+	for _, ns := range referral {
+		published[ns] = true
+	}
+	var missing []string
+	for _, ns := range migrationCombinedNs(state) {
+		if !published[ns] {
+			missing = append(missing, ns)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Printf("The parent (%s) does not yet publish %s; re-run later\n", server, strings.Join(missing, " "))
+		return false, nil
+	}
+	ttl, err := getParentNsTtl(state.Domain)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("The parent (%s) publishes the combined nameservers\n", server)
+	state.AddedAt = time.Now()
+	state.ParentTTL = ttl
+	return true, nil
+}
+
+// migrationChangeDelegation submits a new delegation as part of migrateNameservers, after checking the
+// nameservers and asking for confirmation
+// It returns a bool indicating whether the change was made, and an error object
+func migrationChangeDelegation(state *migrationState, proposed []string) (bool, error) {
+	fmt.Printf("Proposed NS records: %s\n", strings.Join(proposed, " "))
+	findings := checkProposedNameservers(state.Domain, proposed)
+	warnings, errs := reportPreflightFindings(findings, "change")
+	if dryrun {
+		fmt.Printf("= Dryrun, no alterations made\n")
+		return false, nil
+	}
+	proceed, err := preflightAllows(warnings, errs, true)
+	if err != nil {
+		return false, err
+	}
+	if !proceed || (warnings+errs == 0 && !*forceOperation && !askUserYesNo(fmt.Sprintf("Do you want to change the delegation for %s?", state.Domain))) {
+		fmt.Println("Operation aborted")
+		return false, nil
+	}
+	var submit []string
+	for _, ns := range proposed {
+		submit = append(submit, strings.TrimSuffix(ns, "."))
+	}
+	r, err := changeNsInRegistry(state.Domain, submit)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("Delegation for %s changed to %s\n", state.Domain, strings.Join(*r.Data, " "))
+	return true, nil
+}
+
+// getParentNsTtl fetches the TTL of the NS records in the parent's referral for a domain
+func getParentNsTtl(domain string) (uint32, error) {
+	zone, err := getParentZone(domain)
+	if err != nil {
+		return 0, err
+	}
+	servers, err := getAuthServersForZone(zone)
+	if err != nil {
+		return 0, err
+	}
+	for _, server := range servers {
+		r, err := doQueryToServer(server, domain, dns.TypeNS, false)
+		if err != nil || r == nil {
+			continue
+		}
+		for _, rr := range append(r.Ns, r.Answer...) {
+			if ns, ok := rr.(*dns.NS); ok {
+				return ns.Hdr.Ttl, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("cannot determine the parent's NS TTL for %s", domain)
+}
+
+// findAuthoritativeServer returns the first address of the nameservers given that answers authoritatively
+// for the domain, as host:port
+func findAuthoritativeServer(domain string, nameservers []string) (string, error) {
+	for _, ns := range nameservers {
+		addrs, err := getAddressesFromDns(ns)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			server := net.JoinHostPort(addr, "53")
+			r, err := doQueryToServer(server, domain, dns.TypeSOA, false)
+			if err == nil && r != nil && r.Authoritative {
+				return server, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("none of %s answer authoritatively for %s", strings.Join(nameservers, " "), domain)
+}
+
+// transferZone fetches a zone by AXFR and groups it into RRsets
+// DNSSEC records and the SOA are left out, as they are expected to differ between operators, as are
+// records belonging to delegated subzones
+// It returns the RRsets keyed by rrsetKey, each as a sorted list of records, and an error object
+func transferZone(domain string, server string) (map[string][]string, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(domain))
+	t := new(dns.Transfer)
+	env, err := t.In(m, server)
+	if err != nil {
+		return nil, err
+	}
+	var records []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		records = append(records, e.RR...)
+	}
+
+	// records at and below a zone cut belong to the delegated subzone, other than the DS, and aren't
+	// answered authoritatively, so there's nothing to compare them with
+	var cuts []string
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeNS && !strings.EqualFold(rr.Header().Name, dns.Fqdn(domain)) {
+			cuts = append(cuts, rr.Header().Name)
+		}
+	}
+	rrsets := make(map[string][]string)
+	for _, rr := range records {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM, dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY:
+			continue
+		case dns.TypeNS:
+			if strings.EqualFold(rr.Header().Name, dns.Fqdn(domain)) {
+				continue
+			}
+		}
+		var delegated bool
+		for _, cut := range cuts {
+			if dns.IsSubDomain(cut, rr.Header().Name) && !(rr.Header().Rrtype == dns.TypeDS && strings.EqualFold(rr.Header().Name, cut)) {
+				delegated = true
+			}
+		}
+		if delegated {
+			_debug(fmt.Sprintf("skipping %s/%s as it is at or below a zone cut", rr.Header().Name, dns.TypeToString[rr.Header().Rrtype]))
+			continue
+		}
+		key := rrsetKey(rr.Header().Name, rr.Header().Rrtype)
+		rrsets[key] = append(rrsets[key], normaliseRr(rr))
+	}
+	for key := range rrsets {
+		sort.Strings(rrsets[key])
+	}
+	return rrsets, nil
+}
+
+// queryRrset fetches an RRset from a server without recursion
+// It returns the records as a sorted list, and an error object
+func queryRrset(server string, name string, qtype uint16) ([]string, error) {
+	r, err := doQueryToServer(server, name, qtype, false)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []string
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, normaliseRr(rr))
+		}
+	}
+	sort.Strings(rrs)
+	return rrs, nil
+}
+
+// queryDnskeys fetches the DNSKEY records from a server without recursion
+func queryDnskeys(server string, domain string) []dns.DNSKEY {
+	r, err := doQueryToServer(server, domain, dns.TypeDNSKEY, false)
+	if err != nil || r == nil {
+		return nil
+	}
+	var keys []dns.DNSKEY
+	for _, rr := range r.Answer {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, *k)
+		}
+	}
+	return keys
+}
+
+// containsKey determines whether a DNSKEY is in a list of DNSKEYs
+func containsKey(keys []dns.DNSKEY, key dns.DNSKEY) bool {
+	for _, k := range keys {
+		if k.Algorithm == key.Algorithm && k.Flags == key.Flags && k.PublicKey == key.PublicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsetKey identifies an RRset by owner name and type
+func rrsetKey(name string, qtype uint16) string {
+	return fmt.Sprintf("%s/%s", strings.ToLower(dns.Fqdn(name)), dns.TypeToString[qtype])
+}
+
+// normaliseRr presents a record without its TTL and with a lower-cased owner, so records can be compared
+func normaliseRr(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	return rr.String()
+}
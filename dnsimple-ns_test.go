@@ -0,0 +1,178 @@
+// Tests for the nameserver health checks in dnsimple-ns, run against local miekg/dns servers
+// As each tool is its own main package, run with: go test dnsimple-ns.go common.go dnsimple-ns_test.go
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is the zone the test servers answer for
+const testZone = "example.com."
+
+// testServer describes how a local test nameserver should answer
+type testServer struct {
+	authoritative bool
+	serial        uint32
+	nsid          string
+}
+
+// ServeDNS answers SOA queries for the test zone, including the EDNS behaviour probeNameserver checks
+func (ts testServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = ts.authoritative
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(1232, false)
+		if opt.Version() != 0 {
+			m.Rcode = dns.RcodeBadVers
+			w.WriteMsg(m)
+			return
+		}
+		for _, o := range opt.Option {
+			if _, ok := o.(*dns.EDNS0_NSID); ok && ts.nsid != "" {
+				m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(ts.nsid))})
+			}
+		}
+	}
+	if r.Question[0].Qtype == dns.TypeSOA {
+		m.Answer = append(m.Answer, &dns.SOA{
+			Hdr:     dns.RR_Header{Name: testZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      "ns1." + testZone,
+			Mbox:    "hostmaster." + testZone,
+			Serial:  ts.serial,
+			Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 300,
+		})
+	}
+	w.WriteMsg(m)
+}
+
+// startTestServer starts a nameserver on a free port on 127.0.0.1, over both UDP and TCP
+// It returns the server's address as host:port
+func startTestServer(t *testing.T, ts testServer) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening on UDP: %s", err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatalf("error listening on TCP: %s", err)
+	}
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: ts}, {Listener: l, Handler: ts}} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+// TestProbeNameserverHealthy checks a well behaved server is reported as such
+func TestProbeNameserverHealthy(t *testing.T) {
+	server := startTestServer(t, testServer{authoritative: true, serial: 2024010101, nsid: "test1"})
+	h := probeNameserver(testZone, "ns1."+testZone, server)
+	if !h.UDP || !h.TCP {
+		t.Errorf("expected UDP and TCP to be reachable, got UDP %v, TCP %v", h.UDP, h.TCP)
+	}
+	if !h.Authoritative {
+		t.Errorf("expected the AA bit to be set")
+	}
+	if h.Serial != 2024010101 {
+		t.Errorf("expected serial 2024010101, got %d", h.Serial)
+	}
+	if !h.EDNS {
+		t.Errorf("expected EDNS to be compliant")
+	}
+	if h.NSID != "test1" {
+		t.Errorf("expected NSID test1, got %q", h.NSID)
+	}
+	if h.Family != "IPv4" {
+		t.Errorf("expected IPv4, got %s", h.Family)
+	}
+	if len(h.Problems) > 0 {
+		t.Errorf("expected no problems, got %v", h.Problems)
+	}
+}
+
+// TestProbeNameserverLame checks a server that doesn't set the AA bit is reported as lame
+func TestProbeNameserverLame(t *testing.T) {
+	server := startTestServer(t, testServer{authoritative: false, serial: 1})
+	h := probeNameserver(testZone, "ns1."+testZone, server)
+	if h.Authoritative {
+		t.Errorf("expected the AA bit not to be set")
+	}
+	var lame bool
+	for _, p := range h.Problems {
+		if strings.Contains(p, "lame") {
+			lame = true
+		}
+	}
+	if !lame {
+		t.Errorf("expected a lame delegation problem, got %v", h.Problems)
+	}
+}
+
+// TestProbeNameserverTimeout checks a server that doesn't answer is reported as unreachable
+func TestProbeNameserverTimeout(t *testing.T) {
+	saved := probeTimeout
+	probeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { probeTimeout = saved })
+
+	// a UDP socket that's never read from, and nothing listening on TCP
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening on UDP: %s", err)
+	}
+	defer pc.Close()
+
+	h := probeNameserver(testZone, "ns1."+testZone, pc.LocalAddr().String())
+	if h.UDP || h.TCP {
+		t.Errorf("expected UDP and TCP to be unreachable, got UDP %v, TCP %v", h.UDP, h.TCP)
+	}
+	if h.Authoritative || h.EDNS {
+		t.Errorf("expected no AA or EDNS from an unreachable server")
+	}
+	if len(h.Problems) != 2 {
+		t.Errorf("expected UDP and TCP problems, got %v", h.Problems)
+	}
+}
+
+// TestMarkLaggingSerials checks a server behind the others is flagged, allowing for serial wrap around
+func TestMarkLaggingSerials(t *testing.T) {
+	ahead := startTestServer(t, testServer{authoritative: true, serial: 5})
+	behind := startTestServer(t, testServer{authoritative: true, serial: 4294967290})
+	results := []nameserverHealth{
+		probeNameserver(testZone, "ns1."+testZone, ahead),
+		probeNameserver(testZone, "ns2."+testZone, behind),
+	}
+	if markLaggingSerials(results) {
+		t.Errorf("expected the results not to be healthy")
+	}
+	if results[0].SerialLags {
+		t.Errorf("expected serial %d not to lag", results[0].Serial)
+	}
+	if !results[1].SerialLags {
+		t.Errorf("expected serial %d to lag behind %d", results[1].Serial, results[0].Serial)
+	}
+}
+
+// TestNameserverHealthJSON checks the RTT is given in milliseconds in JSON output
+func TestNameserverHealthJSON(t *testing.T) {
+	h := nameserverHealth{RTT: 1500 * time.Microsecond, RTTMs: 1.5}
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("error encoding JSON: %s", err)
+	}
+	if !strings.Contains(string(b), `"rtt_ms":1.5`) || strings.Contains(string(b), `"rtt":`) {
+		t.Errorf("expected rtt_ms of 1.5 and no raw rtt, got %s", b)
+	}
+}
@@ -6,12 +6,12 @@ require (
 	github.com/bigkevmcd/go-configparser v0.0.0-20230427073640-c6b631f70126
 	github.com/dnsimple/dnsimple-go v1.7.0
 	github.com/miekg/dns v1.1.58
+	github.com/shopspring/decimal v1.3.1
 )
 
 require (
 	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
-	github.com/shopspring/decimal v1.3.1 // indirect
 	golang.org/x/mod v0.16.0 // indirect
 	golang.org/x/net v0.22.0 // indirect
 	golang.org/x/oauth2 v0.18.0 // indirect